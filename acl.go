@@ -0,0 +1,70 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"github.com/miekg/dns"
+	"net"
+)
+
+// clientACL rejects queries from clients that are not allowed.
+// It should be the first node of the entry.
+type clientACL struct {
+	allow netlist.Matcher // nil means all clients are allowed
+	deny  netlist.Matcher // can be nil
+	drop  bool            // drop rejected queries instead of replying REFUSED
+}
+
+func (c *clientACL) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	if c.allowed(qCtx.ReqMeta().ClientIP) {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	rejectedQueriesTotal.Inc()
+	qCtx.AddMark(markRouteRejected)
+	if c.drop {
+		qCtx.SetResponse(nil, handler.ContextStatusDropped)
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Rcode = dns.RcodeRefused
+	qCtx.SetResponse(r, handler.ContextStatusRejected)
+	return nil
+}
+
+// allowed reports whether ip is allowed. The deny list has higher
+// priority than the allow list. Unknown clients are allowed only if
+// there is no allow list.
+func (c *clientACL) allowed(ip net.IP) bool {
+	if ip == nil {
+		return c.allow == nil
+	}
+	if c.deny != nil {
+		if ok, _ := c.deny.Match(ip); ok {
+			return false
+		}
+	}
+	if c.allow != nil {
+		ok, _ := c.allow.Match(ip)
+		return ok
+	}
+	return true
+}
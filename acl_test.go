@@ -0,0 +1,160 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/v2data"
+	"github.com/miekg/dns"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeGeoIPDAT writes a v2ray geoip.dat file with the entries.
+func writeGeoIPDAT(t *testing.T, entries map[string][]string) string {
+	t.Helper()
+	l := new(v2data.GeoIPList)
+	for code, cidrs := range entries {
+		e := &v2data.GeoIP{CountryCode: code}
+		for _, s := range cidrs {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ip := n.IP
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			ones, _ := n.Mask.Size()
+			e.Cidr = append(e.Cidr, &v2data.CIDR{Ip: ip, Prefix: uint32(ones)})
+		}
+		l.Entry = append(l.Entry, e)
+	}
+	b, err := proto.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "geoip.dat")
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func newTestACL(t *testing.T, allow, deny []string, drop bool) *clientACL {
+	t.Helper()
+	acl := &clientACL{drop: drop}
+	if len(allow) > 0 {
+		s, err := newIPSet("allow_client", allow, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acl.allow = s
+	}
+	if len(deny) > 0 {
+		s, err := newIPSet("deny_client", deny, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acl.deny = s
+	}
+	return acl
+}
+
+func Test_clientACL_allowed(t *testing.T) {
+	dat := writeGeoIPDAT(t, map[string][]string{
+		"lan":   {"192.168.0.0/16", "fd00::/8"},
+		"guest": {"192.168.100.0/24"},
+	})
+	tests := []struct {
+		name        string
+		allow, deny []string
+		ip          string // empty means unknown
+		want        bool
+	}{
+		{"no list", nil, nil, "1.2.3.4", true},
+		{"no list, unknown", nil, nil, "", true},
+		{"allowed", []string{"192.168.1.0/24"}, nil, "192.168.1.2", true},
+		{"not allowed", []string{"192.168.1.0/24"}, nil, "192.168.2.2", false},
+		{"allow list, unknown", []string{"192.168.1.0/24"}, nil, "", false},
+		{"denied", nil, []string{"192.168.1.2"}, "192.168.1.2", false},
+		{"not denied", nil, []string{"192.168.1.2"}, "192.168.1.3", true},
+		{"deny list, unknown", nil, []string{"192.168.1.2"}, "", true},
+		{"deny over allow", []string{"192.168.0.0/16"}, []string{"192.168.1.0/24"}, "192.168.1.2", false},
+		{"allowed beside deny", []string{"192.168.0.0/16"}, []string{"192.168.1.0/24"}, "192.168.2.2", true},
+		{"geoip allowed", []string{dat + ":lan"}, nil, "192.168.5.5", true},
+		{"geoip ipv6 allowed", []string{dat + ":lan"}, nil, "fd00::1", true},
+		{"geoip not allowed", []string{dat + ":lan"}, nil, "10.0.0.1", false},
+		{"geoip tag case", []string{dat + ":LAN"}, nil, "192.168.5.5", true},
+		{"geoip deny over allow", []string{dat + ":lan"}, []string{dat + ":guest"}, "192.168.100.7", false},
+		{"geoip allowed beside deny", []string{dat + ":lan"}, []string{dat + ":guest"}, "192.168.101.7", true},
+		{"mapped ipv4", []string{"192.168.1.0/24"}, nil, "::ffff:192.168.1.2", true},
+	}
+	for _, tt := range tests {
+		acl := newTestACL(t, tt.allow, tt.deny, false)
+		if got := acl.allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("%s: allowed(%s) = %v, want %v", tt.name, tt.ip, got, tt.want)
+		}
+	}
+
+	if _, err := newIPSet("allow_client", []string{dat + ":none"}, nil); err == nil {
+		t.Error("want an error for a missing geoip tag")
+	}
+}
+
+func Test_clientACL_Exec(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		acl := newTestACL(t, []string{"192.168.1.0/24"}, []string{"192.168.1.66"}, drop)
+		for _, tt := range []struct {
+			ip      string
+			allowed bool
+		}{
+			{"192.168.1.2", true},
+			{"192.168.1.66", false},
+			{"10.0.0.1", false},
+		} {
+			next := &fakeUpstream{reply: func(q *dns.Msg) *dns.Msg { return answerA(q, 300) }}
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			qCtx := handler.NewContext(q, &handler.RequestMeta{ClientIP: net.ParseIP(tt.ip)})
+			if err := acl.Exec(context.Background(), qCtx, handler.WrapExecutable(next)); err != nil {
+				t.Fatal(err)
+			}
+
+			r := qCtx.R()
+			switch {
+			case tt.allowed:
+				if next.count() != 1 || r == nil || r.Rcode != dns.RcodeSuccess {
+					t.Errorf("drop %v, %s: the query is not passed on, reply %v", drop, tt.ip, r)
+				}
+			case drop:
+				if next.count() != 0 || r != nil || qCtx.Status() != handler.ContextStatusDropped {
+					t.Errorf("drop %v, %s: the query is not dropped, reply %v, status %s", drop, tt.ip, r, qCtx.Status())
+				}
+			default:
+				if next.count() != 0 || r == nil || r.Rcode != dns.RcodeRefused || qCtx.Status() != handler.ContextStatusRejected {
+					t.Errorf("drop %v, %s: the query is not refused, reply %v, status %s", drop, tt.ip, r, qCtx.Status())
+				}
+			}
+		}
+	}
+}
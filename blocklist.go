@@ -0,0 +1,138 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/domain"
+	"net"
+	"strings"
+)
+
+// Formats of domain text files.
+const (
+	domainFormatText  = "text"      // mosdns rules. e.g. "domain:example.com"
+	domainFormatABP   = "abp"       // AdBlock Plus rules. e.g. "||example.com^"
+	domainFormatHosts = "hostsfile" // hosts file. e.g. "0.0.0.0 example.com"
+)
+
+// splitDomainFormat splits the format prefix of a domain file arg.
+// e.g. "abp:easylist.txt". format is empty if there is no prefix.
+func splitDomainFormat(s string) (format, file string) {
+	for _, f := range [...]string{domainFormatABP, domainFormatHosts} {
+		if strings.HasPrefix(s, f+":") {
+			return f, s[len(f)+1:]
+		}
+	}
+	return "", s
+}
+
+// detectDomainFormat detects the format of a domain file by its first line.
+func detectDomainFormat(lines []string) string {
+	if len(lines) == 0 {
+		return domainFormatText
+	}
+	l := lines[0]
+	switch {
+	case strings.HasPrefix(l, "[Adblock"), strings.HasPrefix(l, "!"),
+		strings.HasPrefix(l, "||"), strings.HasPrefix(l, "@@"):
+		return domainFormatABP
+	}
+	if fs := strings.Fields(l); len(fs) >= 2 && net.ParseIP(fs[0]) != nil {
+		return domainFormatHosts
+	}
+	return domainFormatText
+}
+
+// convertDomainLines converts lines of the format to mosdns domain rules.
+// Exception rules of abp are returned in exceptions. Lines that are not
+// supported are skipped.
+func convertDomainLines(format string, lines []string) (rules, exceptions []string, skipped int) {
+	switch format {
+	case domainFormatABP:
+		for _, l := range lines {
+			if strings.HasPrefix(l, "!") || strings.HasPrefix(l, "[") { // comments and the header
+				continue
+			}
+			rule, exception, ok := parseABPRule(l)
+			switch {
+			case !ok:
+				skipped++
+			case exception:
+				exceptions = append(exceptions, rule)
+			default:
+				rules = append(rules, rule)
+			}
+		}
+	case domainFormatHosts:
+		for _, l := range lines {
+			fs := strings.Fields(l)
+			if len(fs) < 2 || net.ParseIP(fs[0]) == nil {
+				skipped++
+				continue
+			}
+			for _, name := range fs[1:] {
+				if isLocalHostname(name) {
+					continue
+				}
+				rules = append(rules, domain.MatcherFull+":"+name)
+			}
+		}
+	default:
+		rules = lines
+	}
+	return rules, exceptions, skipped
+}
+
+// parseABPRule parses an abp rule. Only domain rules like "||example.com^"
+// and "@@||example.com^" are supported. Cosmetic rules, url rules and
+// rules with options other than "important" are not.
+func parseABPRule(l string) (rule string, exception, ok bool) {
+	if strings.HasPrefix(l, "@@") {
+		exception = true
+		l = l[2:]
+	}
+	if !strings.HasPrefix(l, "||") {
+		return "", false, false
+	}
+	l = l[2:]
+	if i := strings.IndexByte(l, '$'); i >= 0 {
+		if l[i+1:] != "important" {
+			return "", false, false
+		}
+		l = l[:i]
+	}
+	l = strings.TrimSuffix(l, "^")
+	if len(l) == 0 || strings.IndexFunc(l, func(r rune) bool {
+		return !(r == '-' || r == '.' || r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	}) >= 0 {
+		return "", false, false
+	}
+	return domain.MatcherDomain + ":" + l, exception, true
+}
+
+// isLocalHostname reports whether name is a hostname of the local machine
+// that often appears in hosts files.
+func isLocalHostname(name string) bool {
+	switch name {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost",
+		"ip6-localhost", "ip6-loopback", "ip6-localnet", "ip6-mcastprefix",
+		"ip6-allnodes", "ip6-allrouters", "ip6-allhosts", "0.0.0.0":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_parseABPRule(t *testing.T) {
+	tests := []struct {
+		l         string
+		rule      string
+		exception bool
+		ok        bool
+	}{
+		{"||example.com^", "domain:example.com", false, true},
+		{"||example.com", "domain:example.com", false, true},
+		{"||ads.example-cdn.com^", "domain:ads.example-cdn.com", false, true},
+		{"@@||example.com^", "domain:example.com", true, true},
+		{"||example.com^$important", "domain:example.com", false, true},
+		{"@@||example.com^$important", "domain:example.com", true, true},
+		{"||example.com^$third-party", "", false, false},
+		{"||example.com^$important,third-party", "", false, false},
+		{"||example.com^$", "", false, false},
+		{"||example.com/ads.js", "", false, false},
+		{"||*.example.com^", "", false, false},
+		{"||^", "", false, false},
+		{"example.com", "", false, false},
+		{"|https://example.com^", "", false, false},
+		{"example.com##.ad", "", false, false},
+		{"@@example.com", "", false, false},
+	}
+	for _, tt := range tests {
+		rule, exception, ok := parseABPRule(tt.l)
+		if rule != tt.rule || exception != tt.exception || ok != tt.ok {
+			t.Errorf("parseABPRule(%q) = %q, %v, %v, want %q, %v, %v", tt.l, rule, exception, ok, tt.rule, tt.exception, tt.ok)
+		}
+	}
+}
+
+func Test_detectDomainFormat(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"empty", nil, domainFormatText},
+		{"abp header", []string{"[Adblock Plus 2.0]", "||example.com^"}, domainFormatABP},
+		{"abp comment", []string{"! Title: list", "||example.com^"}, domainFormatABP},
+		{"abp rule", []string{"||example.com^"}, domainFormatABP},
+		{"abp exception", []string{"@@||example.com^"}, domainFormatABP},
+		{"hosts", []string{"0.0.0.0 example.com"}, domainFormatHosts},
+		{"hosts ipv6", []string{"::1 example.com"}, domainFormatHosts},
+		{"text", []string{"domain:example.com"}, domainFormatText},
+		{"plain domain", []string{"example.com"}, domainFormatText},
+		{"ip only", []string{"0.0.0.0"}, domainFormatText},
+		// only the first line is used.
+		{"text first", []string{"example.com", "||example.com^"}, domainFormatText},
+		{"hosts first", []string{"127.0.0.1 localhost", "||example.com^"}, domainFormatHosts},
+	}
+	for _, tt := range tests {
+		if got := detectDomainFormat(tt.lines); got != tt.want {
+			t.Errorf("%s: detectDomainFormat(%q) = %s, want %s", tt.name, tt.lines, got, tt.want)
+		}
+	}
+}
+
+func Test_convertDomainLines(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		lines      []string
+		rules      []string
+		exceptions []string
+		skipped    int
+	}{
+		{
+			name:   "abp",
+			format: domainFormatABP,
+			lines: []string{
+				"[Adblock Plus 2.0]",
+				"! comment",
+				"||ads.example.com^",
+				"@@||good.ads.example.com^",
+				"||tracker.example.com^$important",
+				"||example.com^$third-party",
+				"example.com##.banner",
+			},
+			rules:      []string{"domain:ads.example.com", "domain:tracker.example.com"},
+			exceptions: []string{"domain:good.ads.example.com"},
+			skipped:    2,
+		},
+		{
+			name:   "hosts",
+			format: domainFormatHosts,
+			lines: []string{
+				"127.0.0.1 localhost",
+				"::1 ip6-localhost ip6-loopback",
+				"0.0.0.0 ads.example.com tracker.example.com",
+				"0.0.0.0",
+				"example.com",
+			},
+			rules:   []string{"full:ads.example.com", "full:tracker.example.com"},
+			skipped: 2,
+		},
+		{
+			name:   "text",
+			format: domainFormatText,
+			lines:  []string{"domain:example.com", "keyword:ads"},
+			rules:  []string{"domain:example.com", "keyword:ads"},
+		},
+	}
+	for _, tt := range tests {
+		rules, exceptions, skipped := convertDomainLines(tt.format, tt.lines)
+		if !reflect.DeepEqual(rules, tt.rules) || !reflect.DeepEqual(exceptions, tt.exceptions) || skipped != tt.skipped {
+			t.Errorf("%s: got %q, %q, %d, want %q, %q, %d", tt.name, rules, exceptions, skipped, tt.rules, tt.exceptions, tt.skipped)
+		}
+	}
+}
+
+func Test_splitDomainFormat(t *testing.T) {
+	tests := []struct {
+		s, format, file string
+	}{
+		{"abp:easylist.txt", domainFormatABP, "easylist.txt"},
+		{"hostsfile:/etc/hosts", domainFormatHosts, "/etc/hosts"},
+		{"abp:https://example.com/easylist.txt", domainFormatABP, "https://example.com/easylist.txt"},
+		{"ads.txt", "", "ads.txt"},
+		{"geosite.dat:category-ads", "", "geosite.dat:category-ads"},
+	}
+	for _, tt := range tests {
+		format, file := splitDomainFormat(tt.s)
+		if format != tt.format || file != tt.file {
+			t.Errorf("splitDomainFormat(%q) = %q, %q, want %q, %q", tt.s, format, file, tt.format, tt.file)
+		}
+	}
+}
+
+func Test_domainSet_exceptions(t *testing.T) {
+	dir := t.TempDir()
+	abp := filepath.Join(dir, "easylist.txt")
+	if err := os.WriteFile(abp, []byte(`[Adblock Plus 2.0]
+! Title: test list
+||ads.example.com^
+@@||good.ads.example.com^
+||tracker.example.com^$important
+||example.org^$third-party
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hosts := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(hosts, []byte("# comment\n127.0.0.1 localhost\n0.0.0.0 malware.example.net # inline\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newDomainSet("block", []string{abp, hosts}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		match     bool
+		exception bool
+	}{
+		{"ads.example.com.", true, false},
+		{"cdn.ads.example.com.", true, false},
+		{"good.ads.example.com.", true, true},
+		{"a.good.ads.example.com.", true, true},
+		{"tracker.example.com.", true, false},
+		{"example.org.", false, false},
+		{"malware.example.net.", true, false},
+		{"sub.malware.example.net.", false, false},
+		{"localhost.", false, false},
+		{"example.com.", false, false},
+	}
+	for _, tt := range tests {
+		if _, ok := s.Match(tt.name); ok != tt.match {
+			t.Errorf("Match(%s) = %v, want %v", tt.name, ok, tt.match)
+		}
+		if _, ok := s.exceptions().Match(tt.name); ok != tt.exception {
+			t.Errorf("exceptions().Match(%s) = %v, want %v", tt.name, ok, tt.exception)
+		}
+	}
+	if s.Len() != 4 || s.exceptions().Len() != 1 {
+		t.Fatalf("Len() = %d, exceptions().Len() = %d, want 4, 1", s.Len(), s.exceptions().Len())
+	}
+}
@@ -0,0 +1,346 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/utils"
+	cachePlugin "github.com/IrineSistiana/mosdns/v3/dispatcher/plugin/executable/cache"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// maxIndexedQueries is the max number of questions in the lookup
+	// index if the cache size is not configured.
+	maxIndexedQueries = 1024
+	// maxQueryVariants is the max number of queries of a question in the
+	// lookup index, e.g. queries with different flags or EDNS options.
+	maxQueryVariants = 8
+)
+
+// dnsCache wraps the cache plugin of mosdns with metrics. Queries are
+// counted as hits (answered from the cache, including the expired
+// answers of the lazy cache), misses and lazy updates.
+//
+// The plugin does not expose its backend, so the admin api looks up
+// responses by replaying the queries that were stored (see lookup), and
+// flushes the cache by replacing the plugin.
+type dnsCache struct {
+	*handler.BP
+	args cachePlugin.Args
+	p    atomic.Value // handler.ExecutablePlugin, replaced by flush
+
+	mu      sync.Mutex
+	queries map[string][]*dns.Msg // stored queries by question, see indexKey
+}
+
+var _ handler.ExecutablePlugin = (*dnsCache)(nil)
+
+func newDNSCache(bp *handler.BP, args cachePlugin.Args) (*dnsCache, error) {
+	args.CacheEverything = true // keyed by the whole query
+	c := &dnsCache{BP: bp, args: args}
+	p, err := c.newPlugin()
+	if err != nil {
+		return nil, err
+	}
+	c.p.Store(p)
+	c.queries = make(map[string][]*dns.Msg)
+	return c, nil
+}
+
+func (c *dnsCache) newPlugin() (handler.ExecutablePlugin, error) {
+	args := c.args // Init modifies args
+	p, err := cachePlugin.Init(handler.NewBP(c.Tag(), cachePlugin.PluginType), &args)
+	if err != nil {
+		return nil, err
+	}
+	return p.(handler.ExecutablePlugin), nil
+}
+
+func (c *dnsCache) plugin() handler.ExecutablePlugin {
+	return c.p.Load().(handler.ExecutablePlugin)
+}
+
+type cacheCallKey struct{}
+
+// cacheCall is the state of a query in the cache.
+type cacheCall struct {
+	q       *dns.Msg
+	e       *entry // the entry that executes the query, can be nil
+	next    handler.ExecutableChainNode
+	missed  bool
+	invalid *dns.Msg // the response that must not be cached, see cacheNext
+	status  handler.ContextStatus
+}
+
+func (c *dnsCache) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	call := &cacheCall{q: qCtx.Q(), e: entryOf(ctx), next: next}
+	ctx = context.WithValue(ctx, cacheCallKey{}, call)
+	err := c.plugin().Exec(ctx, qCtx, handler.WrapExecutable(&cacheNext{c: c, call: call}))
+	if call.invalid != nil {
+		qCtx.SetResponse(call.invalid, call.status)
+	}
+	switch {
+	case call.missed:
+		cacheQueriesTotal.WithLabelValues("miss").Inc()
+		if r := qCtx.R(); r != nil && call.invalid == nil {
+			c.index(call.q, r)
+		}
+	case qCtx.R() != nil:
+		cacheQueriesTotal.WithLabelValues("hit").Inc()
+		qCtx.AddMark(markRouteCache)
+	}
+	return err
+}
+
+// cacheNext is the next node of the cache plugin. It runs the rest of the
+// chain for a cache miss or a lazy update.
+type cacheNext struct {
+	c    *dnsCache
+	call *cacheCall
+}
+
+func (n *cacheNext) Exec(ctx context.Context, qCtx *handler.Context, _ handler.ExecutableChainNode) error {
+	call := n.call
+	inQuery := ctx.Value(cacheCallKey{}) == call
+	if inQuery {
+		call.missed = true
+	} else {
+		// A lazy update that runs after the query. Its entry may have
+		// been replaced by a reload, the update is skipped if the entry
+		// is shut down.
+		if call.e != nil {
+			if !call.e.tryHold() {
+				return nil
+			}
+			defer call.e.release()
+		}
+		n.c.L().Debug("lazy cache update", qCtx.InfoField())
+		cacheQueriesTotal.WithLabelValues("lazy_update").Inc()
+	}
+
+	err := handler.ExecChainNode(ctx, qCtx, call.next)
+
+	// Upstreams don't check the question of responses. Responses that
+	// don't have the question of the query are replaced with SERVFAIL,
+	// which is not cached by the plugin. The query still gets the
+	// original response.
+	q := qCtx.Q()
+	if r := qCtx.R(); r != nil && len(q.Question) == 1 && !sameQuestion(q, r) {
+		if inQuery {
+			call.invalid, call.status = r, qCtx.Status()
+		}
+		f := new(dns.Msg)
+		f.SetRcode(q, dns.RcodeServerFailure)
+		qCtx.SetResponse(f, qCtx.Status())
+	}
+	return err
+}
+
+// sameQuestion reports whether r has exactly one question, and it is the
+// question of q. The name is case-insensitive.
+func sameQuestion(q, r *dns.Msg) bool {
+	if len(q.Question) != 1 || len(r.Question) != 1 {
+		return false
+	}
+	qq, rq := q.Question[0], r.Question[0]
+	return qq.Qtype == rq.Qtype && qq.Qclass == rq.Qclass && strings.EqualFold(qq.Name, rq.Name)
+}
+
+// indexKey returns the key of the question in the lookup index.
+func indexKey(name string, qtype uint16) string {
+	return strings.ToLower(dns.Fqdn(name)) + " " + dns.TypeToString[qtype]
+}
+
+// index records q, whose response r may be stored by the plugin, for
+// lookup. The index is bounded, queries of old questions are removed
+// when it is full.
+func (c *dnsCache) index(q, r *dns.Msg) {
+	if len(q.Question) != 1 || r.Rcode != dns.RcodeSuccess || r.Truncated {
+		return
+	}
+	key := indexKey(q.Question[0].Name, q.Question[0].Qtype)
+	msgKey, err := utils.GetMsgKey(q, 0)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	qs := c.queries[key]
+	for _, v := range qs {
+		if k, _ := utils.GetMsgKey(v, 0); k == msgKey {
+			return
+		}
+	}
+	limit := c.args.Size
+	if limit <= 0 {
+		limit = maxIndexedQueries
+	}
+	if len(qs) == 0 && len(c.queries) >= limit {
+		for k := range c.queries { // remove a random question
+			delete(c.queries, k)
+			break
+		}
+	}
+	if len(qs) >= maxQueryVariants {
+		qs = qs[1:]
+	}
+	c.queries[key] = append(qs, q.Copy())
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	Profile string   `json:"profile,omitempty"`
+	AD      bool     `json:"ad"`
+	CD      bool     `json:"cd"`
+	DO      bool     `json:"do"`
+	ECS     string   `json:"ecs,omitempty"`
+	Rcode   string   `json:"rcode"`
+	Answer  []string `json:"answer"` // ttls are the remaining ones
+}
+
+// lookup returns cached responses of the question. Each response is
+// looked up with a query that was stored, queries with different flags
+// and EDNS options have different responses.
+func (c *dnsCache) lookup(name string, qtype uint16) ([]*cacheEntry, error) {
+	key := indexKey(name, qtype)
+	c.mu.Lock()
+	qs := append([]*dns.Msg(nil), c.queries[key]...)
+	c.mu.Unlock()
+
+	var entries []*cacheEntry
+	var stale []*dns.Msg
+	for _, q := range qs {
+		r, err := c.probe(q.Copy())
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			stale = append(stale, q)
+			continue
+		}
+		e := &cacheEntry{
+			AD:     q.AuthenticatedData,
+			CD:     q.CheckingDisabled,
+			Rcode:  dns.RcodeToString[r.Rcode],
+			Answer: make([]string, 0, len(r.Answer)),
+		}
+		if opt := q.IsEdns0(); opt != nil {
+			e.DO = opt.Do()
+			for _, o := range opt.Option {
+				if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+					e.ECS = s.String()
+				}
+			}
+		}
+		for _, rr := range r.Answer {
+			e.Answer = append(e.Answer, rr.String())
+		}
+		entries = append(entries, e)
+	}
+	c.unindex(key, stale)
+	return entries, nil
+}
+
+// probe returns the cached response of q, or nil. Misses and expired
+// responses are not updated.
+func (c *dnsCache) probe(q *dns.Msg) (*dns.Msg, error) {
+	p := new(missProbe)
+	ctx := context.WithValue(context.Background(), cacheCallKey{}, p)
+	qCtx := handler.NewContext(q, nil)
+	if err := c.plugin().Exec(ctx, qCtx, handler.WrapExecutable(p)); err != nil {
+		return nil, err
+	}
+	if p.missed {
+		return nil, nil
+	}
+	return qCtx.R(), nil
+}
+
+// missProbe is the next node of the cache plugin when probing. It records
+// misses and never responds, so nothing will be stored. Lazy updates of
+// expired responses do nothing.
+type missProbe struct {
+	missed bool
+}
+
+func (p *missProbe) Exec(ctx context.Context, _ *handler.Context, _ handler.ExecutableChainNode) error {
+	if ctx.Value(cacheCallKey{}) == p {
+		p.missed = true
+	}
+	return nil
+}
+
+// unindex removes queries of key that are no longer cached.
+func (c *dnsCache) unindex(key string, qs []*dns.Msg) {
+	if len(qs) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var kept []*dns.Msg
+	for _, v := range c.queries[key] {
+		removed := false
+		for _, q := range qs {
+			if v == q {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == 0 {
+		delete(c.queries, key)
+	} else {
+		c.queries[key] = kept
+	}
+}
+
+// flush removes all cached responses by replacing the plugin. Only the
+// memory backend is supported.
+func (c *dnsCache) flush() error {
+	if len(c.args.Redis) > 0 {
+		return errors.New("flushing the redis cache is not supported")
+	}
+	p, err := c.newPlugin()
+	if err != nil {
+		return err
+	}
+	old := c.plugin()
+	c.p.Store(p)
+	c.mu.Lock()
+	c.queries = make(map[string][]*dns.Msg)
+	c.mu.Unlock()
+	if err := old.Shutdown(); err != nil {
+		c.L().Warn("failed to shutdown the old cache", zap.Error(err))
+	}
+	return nil
+}
+
+func (c *dnsCache) Shutdown() error {
+	return c.plugin().Shutdown()
+}
@@ -0,0 +1,301 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	cachePlugin "github.com/IrineSistiana/mosdns/v3/dispatcher/plugin/executable/cache"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeUpstream answers queries with reply and counts them.
+type fakeUpstream struct {
+	calls int32
+	reply func(q *dns.Msg) *dns.Msg
+}
+
+func (u *fakeUpstream) Exec(_ context.Context, qCtx *handler.Context, _ handler.ExecutableChainNode) error {
+	atomic.AddInt32(&u.calls, 1)
+	qCtx.SetResponse(u.reply(qCtx.Q()), handler.ContextStatusResponded)
+	return nil
+}
+
+func (u *fakeUpstream) count() int {
+	return int(atomic.LoadInt32(&u.calls))
+}
+
+// answerA returns a reply of q with an A record.
+func answerA(q *dns.Msg, ttl uint32) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.IPv4(1, 2, 3, 4),
+	})
+	return r
+}
+
+func newTestCache(t *testing.T, args cachePlugin.Args) *dnsCache {
+	t.Helper()
+	c, err := newDNSCache(handler.NewBP("cache", cachePlugin.PluginType), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Shutdown() })
+	return c
+}
+
+func execQuery(t *testing.T, e handler.Executable, next handler.Executable, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	qCtx := handler.NewContext(q, nil)
+	if err := e.Exec(context.Background(), qCtx, handler.WrapExecutable(next)); err != nil {
+		t.Fatal(err)
+	}
+	return qCtx.R()
+}
+
+func Test_dnsCache_replyWithoutQuestion(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		reply func(q *dns.Msg) *dns.Msg
+	}{
+		{"no question", func(q *dns.Msg) *dns.Msg {
+			r := answerA(q, 300)
+			r.Question = nil
+			return r
+		}},
+		{"other question", func(q *dns.Msg) *dns.Msg {
+			r := answerA(q, 300)
+			r.Question[0].Name = "other.example."
+			return r
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(t, cachePlugin.Args{Size: 16})
+			u := &fakeUpstream{reply: tt.reply}
+			for i := 0; i < 2; i++ {
+				// the query still gets the upstream's response
+				if r := execQuery(t, c, u, "example.com.", dns.TypeA); r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+					t.Fatalf("unexpected response %v", r)
+				}
+			}
+			if u.count() != 2 {
+				t.Fatalf("the reply should not be cached, upstream calls: %d", u.count())
+			}
+		})
+	}
+}
+
+// queryWithECS returns a query of the name with an ECS option.
+func queryWithECS(name string, subnet string) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	_, n, _ := net.ParseCIDR(subnet)
+	ones, _ := n.Mask.Size()
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.SetUDPSize(1232)
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: uint8(ones),
+		Address:       n.IP,
+	})
+	q.Extra = append(q.Extra, opt)
+	return q
+}
+
+func Test_dnsCache_ecs(t *testing.T) {
+	c := newTestCache(t, cachePlugin.Args{Size: 16})
+	u := &fakeUpstream{reply: func(q *dns.Msg) *dns.Msg {
+		// answer the subnet as the address
+		r := answerA(q, 300)
+		ecs := q.IsEdns0().Option[0].(*dns.EDNS0_SUBNET)
+		r.Answer[0].(*dns.A).A = ecs.Address
+		return r
+	}}
+	exec := func(subnet string) string {
+		qCtx := handler.NewContext(queryWithECS("example.com.", subnet), nil)
+		if err := c.Exec(context.Background(), qCtx, handler.WrapExecutable(u)); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R().Answer[0].(*dns.A).A.String()
+	}
+	if got := exec("1.2.3.0/24"); got != "1.2.3.0" {
+		t.Fatalf("got %s", got)
+	}
+	if got := exec("5.6.7.0/24"); got != "5.6.7.0" {
+		t.Fatalf("queries with different ECS share a response, got %s", got)
+	}
+	if got := exec("1.2.3.0/24"); got != "1.2.3.0" || u.count() != 2 {
+		t.Fatalf("got %s, upstream calls: %d", got, u.count())
+	}
+}
+
+func Test_dnsCache_metrics(t *testing.T) {
+	count := func(result string) float64 {
+		return testutil.ToFloat64(cacheQueriesTotal.WithLabelValues(result))
+	}
+	hit, miss, lazy := count("hit"), count("miss"), count("lazy_update")
+	c := newTestCache(t, cachePlugin.Args{Size: 16, LazyCacheTTL: 60})
+	u := &fakeUpstream{reply: func(q *dns.Msg) *dns.Msg { return answerA(q, 1) }}
+
+	execQuery(t, c, u, "example.com.", dns.TypeA)
+	execQuery(t, c, u, "example.com.", dns.TypeA)
+	time.Sleep(1100 * time.Millisecond)
+	execQuery(t, c, u, "example.com.", dns.TypeA) // expired
+	time.Sleep(50 * time.Millisecond)             // wait for the lazy update
+	if d := count("miss") - miss; d != 1 {
+		t.Errorf("misses: %v", d)
+	}
+	if d := count("hit") - hit; d != 2 {
+		t.Errorf("hits: %v", d)
+	}
+	if d := count("lazy_update") - lazy; d != 1 || u.count() != 2 {
+		t.Errorf("lazy updates: %v, upstream calls: %d", d, u.count())
+	}
+}
+
+func Test_dnsCache_lookupAndFlush(t *testing.T) {
+	c := newTestCache(t, cachePlugin.Args{Size: 16})
+	u := &fakeUpstream{reply: func(q *dns.Msg) *dns.Msg { return answerA(q, 300) }}
+	execQuery(t, c, u, "example.com.", dns.TypeA)
+	qCtx := handler.NewContext(queryWithECS("example.com.", "1.2.3.0/24"), nil)
+	if err := c.Exec(context.Background(), qCtx, handler.WrapExecutable(u)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := c.lookup("EXAMPLE.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ECS != "" || entries[1].ECS != "1.2.3.0/24/0" || len(entries[0].Answer) != 1 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if entries, _ := c.lookup("example.com.", dns.TypeAAAA); len(entries) != 0 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	if err := c.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := c.lookup("example.com.", dns.TypeA); len(entries) != 0 {
+		t.Fatalf("unexpected entries after flush %+v", entries)
+	}
+	execQuery(t, c, u, "example.com.", dns.TypeA)
+	if u.count() != 3 {
+		t.Fatalf("want a cache miss after flush, upstream calls: %d", u.count())
+	}
+	if entries, _ := c.lookup("example.com.", dns.TypeA); len(entries) != 1 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
+
+// Test_dnsCache_sameAsPlugin checks that dnsCache behaves like the cache
+// plugin of mosdns it wraps.
+func Test_dnsCache_sameAsPlugin(t *testing.T) {
+	type query struct {
+		name  string
+		qtype uint16
+	}
+	q := query{"example.com.", dns.TypeA}
+	for _, tt := range []struct {
+		name    string
+		args    cachePlugin.Args
+		reply   func(q *dns.Msg) *dns.Msg
+		queries []query
+		wait    time.Duration // between queries, for expiration
+	}{
+		{name: "hit", reply: func(q *dns.Msg) *dns.Msg { return answerA(q, 300) }, queries: []query{q, q, q}},
+		{name: "different qtype", reply: func(q *dns.Msg) *dns.Msg { return answerA(q, 300) },
+			queries: []query{q, {"example.com.", dns.TypeAAAA}, q}},
+		{name: "name case", reply: func(q *dns.Msg) *dns.Msg { return answerA(q, 300) },
+			queries: []query{q, {"EXAMPLE.com.", dns.TypeA}, q}},
+		{name: "nxdomain", reply: func(q *dns.Msg) *dns.Msg {
+			r := new(dns.Msg)
+			r.SetRcode(q, dns.RcodeNameError)
+			return r
+		}, queries: []query{q, q}},
+		{name: "truncated", reply: func(q *dns.Msg) *dns.Msg {
+			r := answerA(q, 300)
+			r.Truncated = true
+			return r
+		}, queries: []query{q, q}},
+		{name: "zero ttl", reply: func(q *dns.Msg) *dns.Msg { return answerA(q, 0) }, queries: []query{q, q}},
+		{name: "empty answer", reply: func(q *dns.Msg) *dns.Msg {
+			r := new(dns.Msg)
+			r.SetReply(q)
+			return r
+		}, queries: []query{q, q}},
+		{name: "expired", reply: func(q *dns.Msg) *dns.Msg { return answerA(q, 1) },
+			queries: []query{q, q}, wait: 1100 * time.Millisecond},
+		{name: "lazy", args: cachePlugin.Args{LazyCacheTTL: 60},
+			reply:   func(q *dns.Msg) *dns.Msg { return answerA(q, 1) },
+			queries: []query{q, q}, wait: 1100 * time.Millisecond},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			type result struct {
+				calls int
+				rcode []int
+				ttl   []uint32
+			}
+			run := func(e handler.Executable) result {
+				u := &fakeUpstream{reply: tt.reply}
+				var res result
+				for i, q := range tt.queries {
+					if i > 0 {
+						time.Sleep(tt.wait)
+					}
+					r := execQuery(t, e, u, q.name, q.qtype)
+					res.rcode = append(res.rcode, r.Rcode)
+					var ttl uint32
+					if len(r.Answer) > 0 {
+						ttl = r.Answer[0].Header().Ttl
+					}
+					res.ttl = append(res.ttl, ttl)
+				}
+				time.Sleep(50 * time.Millisecond) // wait for lazy updates
+				res.calls = u.count()
+				return res
+			}
+
+			args := tt.args
+			args.Size = 16
+			p, err := cachePlugin.Init(handler.NewBP("cache", cachePlugin.PluginType), &args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.(handler.ExecutablePlugin).Shutdown()
+			want := run(p.(handler.ExecutablePlugin))
+			got := run(newTestCache(t, tt.args))
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("dnsCache: %+v, plugin: %+v", got, want)
+			}
+		})
+	}
+}
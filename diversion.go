@@ -0,0 +1,115 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"github.com/miekg/dns"
+	"net"
+)
+
+// parseQtypes parses query types like "A", "HTTPS" or "65".
+func parseQtypes(ss []string) ([]int, error) {
+	qtypes := make([]int, 0, len(ss))
+	for _, s := range ss {
+		if len(s) == 0 {
+			return nil, fmt.Errorf("empty query type")
+		}
+		t, err := parseQtype(s)
+		if err != nil {
+			return nil, err
+		}
+		qtypes = append(qtypes, int(t))
+	}
+	return qtypes, nil
+}
+
+// answerIPMatcher matches responses that have local ips. Besides A/AAAA
+// records, address hints of HTTPS/SVCB records are checked. For other
+// query types than A/AAAA, if the response has no address, the A records
+// of the same name resolved by local decide.
+type answerIPMatcher struct {
+	ips   netlist.Matcher
+	local *forward
+}
+
+func (m *answerIPMatcher) Match(ctx context.Context, qCtx *handler.Context) (bool, error) {
+	q, r := qCtx.Q(), qCtx.R()
+	if r == nil || len(q.Question) != 1 {
+		return false, nil
+	}
+	matched, hasAddr, err := m.matchMsg(r)
+	if err != nil || hasAddr {
+		return matched, err
+	}
+	if qtype := q.Question[0].Qtype; qtype == dns.TypeA || qtype == dns.TypeAAAA {
+		return false, nil
+	}
+
+	aq := q.Copy()
+	aq.Question[0].Qtype = dns.TypeA
+	ar, _, err := m.local.exchange(ctx, handler.NewContext(aq, qCtx.ReqMeta()))
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve A records, %w", err)
+	}
+	matched, _, err = m.matchMsg(ar)
+	return matched, err
+}
+
+// matchMsg reports whether any address in the answer of msg is a local
+// ip, and whether msg has any address.
+func (m *answerIPMatcher) matchMsg(msg *dns.Msg) (matched, hasAddr bool, err error) {
+	for _, rr := range msg.Answer {
+		var ips []net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		case *dns.HTTPS:
+			ips = svcbHints(&rr.SVCB)
+		case *dns.SVCB:
+			ips = svcbHints(rr)
+		}
+		for _, ip := range ips {
+			hasAddr = true
+			ok, err := m.ips.Match(ip)
+			if err != nil || ok {
+				return ok, true, err
+			}
+		}
+	}
+	return false, hasAddr, nil
+}
+
+// svcbHints returns the ipv4hint and ipv6hint addresses of rr.
+func svcbHints(rr *dns.SVCB) []net.IP {
+	var ips []net.IP
+	for _, kv := range rr.Value {
+		switch kv := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			ips = append(ips, kv.Hint...)
+		case *dns.SVCBIPv6Hint:
+			ips = append(ips, kv.Hint...)
+		}
+	}
+	return ips
+}
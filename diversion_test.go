@@ -0,0 +1,131 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func newTestAnswerIPMatcher(t *testing.T, local *testDNSServer) *answerIPMatcher {
+	t.Helper()
+	ips, err := newIPSet("local_ip", []string{"192.168.0.0/16", "fd00::/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := newForward(&Opt{}, "local", markRouteLocal, []string{"udp://" + local.addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Shutdown() })
+	return &answerIPMatcher{ips: ips, local: f}
+}
+
+// matchReply runs m on a query of name and qtype that is replied with rrs.
+func matchReply(t *testing.T, m *answerIPMatcher, name string, qtype uint16, rrs ...string) bool {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Answer = append(r.Answer, rr)
+	}
+	qCtx := handler.NewContext(q, nil)
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	ok, err := m.Match(context.Background(), qCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func Test_answerIPMatcher(t *testing.T) {
+	local := newTestDNSServer(t, func(q *dns.Msg) *dns.Msg {
+		if q.Question[0].Name == "lan.example." {
+			return answerRR("x. 60 IN A 192.168.1.10")(q)
+		}
+		return answerRR("x. 60 IN A 93.184.216.34")(q)
+	})
+	m := newTestAnswerIPMatcher(t, local)
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		rrs   []string
+		want  bool
+	}{
+		{"A local", "a.example.", dns.TypeA, []string{"a.example. 60 IN A 192.168.1.1"}, true},
+		{"A remote", "a.example.", dns.TypeA, []string{"a.example. 60 IN A 8.8.8.8"}, false},
+		{"A any local", "a.example.", dns.TypeA, []string{"a.example. 60 IN A 8.8.8.8", "a.example. 60 IN A 192.168.1.1"}, true},
+		{"AAAA local", "a.example.", dns.TypeAAAA, []string{"a.example. 60 IN AAAA fd00::1"}, true},
+		{"AAAA remote", "a.example.", dns.TypeAAAA, []string{"a.example. 60 IN AAAA 2001:db8::1"}, false},
+		{"CNAME then A", "a.example.", dns.TypeA, []string{"a.example. 60 IN CNAME b.example.", "b.example. 60 IN A 192.168.1.1"}, true},
+		{"A without answer", "lan.example.", dns.TypeA, nil, false},
+		{"HTTPS ipv4hint", "a.example.", dns.TypeHTTPS, []string{`a.example. 60 IN HTTPS 1 . alpn="h2" ipv4hint="192.168.1.1"`}, true},
+		{"HTTPS ipv6hint", "a.example.", dns.TypeHTTPS, []string{`a.example. 60 IN HTTPS 1 . ipv6hint="fd00::1"`}, true},
+		{"HTTPS remote hint", "a.example.", dns.TypeHTTPS, []string{`a.example. 60 IN HTTPS 1 . ipv4hint="8.8.8.8"`}, false},
+		{"SVCB ipv4hint", "_dns.a.example.", dns.TypeSVCB, []string{`_dns.a.example. 60 IN SVCB 1 dns.a.example. ipv4hint="192.168.1.53"`}, true},
+		// no address in the answer, the A records resolved by local decide.
+		{"HTTPS without hint, local A", "lan.example.", dns.TypeHTTPS, []string{`lan.example. 60 IN HTTPS 1 . alpn="h2"`}, true},
+		{"HTTPS without hint, remote A", "www.example.", dns.TypeHTTPS, []string{`www.example. 60 IN HTTPS 1 . alpn="h2"`}, false},
+		{"MX, local A", "lan.example.", dns.TypeMX, []string{"lan.example. 60 IN MX 10 mx.lan.example."}, true},
+	}
+	for _, tt := range tests {
+		if got := matchReply(t, m, tt.qname, tt.qtype, tt.rrs...); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	// only the queries without an address in the answer are resolved again.
+	if n := local.count(); n != 3 {
+		t.Fatalf("local upstream got %d queries, want 3", n)
+	}
+}
+
+func Test_answerIPMatcher_noQuestion(t *testing.T) {
+	local := newTestDNSServer(t, answerRR("x. 60 IN A 192.168.1.10"))
+	m := newTestAnswerIPMatcher(t, local)
+
+	for _, questions := range [][]dns.Question{
+		nil,
+		{{Name: "a.example.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}, {Name: "b.example.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}},
+	} {
+		q := new(dns.Msg)
+		q.Question = questions
+		r := new(dns.Msg)
+		r.SetReply(q)
+		rr, _ := dns.NewRR("a.example. 60 IN A 192.168.1.1")
+		r.Answer = append(r.Answer, rr)
+		qCtx := handler.NewContext(q, nil)
+		qCtx.SetResponse(r, handler.ContextStatusResponded)
+		ok, err := m.Match(context.Background(), qCtx)
+		if ok || err != nil {
+			t.Fatalf("%d questions: got %v, %v", len(questions), ok, err)
+		}
+	}
+	if n := local.count(); n != 0 {
+		t.Fatalf("local upstream got %d queries", n)
+	}
+}
@@ -0,0 +1,151 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/utils"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
+)
+
+// DoQ error codes. See RFC 9250 4.3.
+const (
+	doqNoError       quic.ApplicationErrorCode = 0x0
+	doqInternalError quic.ApplicationErrorCode = 0x1
+	doqProtocolError quic.ApplicationErrorCode = 0x2
+)
+
+const (
+	doqStreamReadTimeout  = time.Second * 2
+	doqStreamWriteTimeout = time.Second
+	doqIdleTimeout        = time.Second * 30
+
+	// doqCloseLinger is the time to wait after the last response before
+	// closing the listener. Closing it closes all connections immediately,
+	// responses that are not sent yet will be lost.
+	doqCloseLinger = time.Millisecond * 500
+)
+
+// listenDoQ starts a DoQ listener on addr. 0-RTT is accepted.
+func listenDoQ(addr string, tlsConfig *tls.Config) (quic.EarlyListener, error) {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"doq"}
+	return quic.ListenAddrEarly(addr, tlsConfig, &quic.Config{
+		MaxIdleTimeout:     doqIdleTimeout,
+		MaxIncomingStreams: 100,
+	})
+}
+
+type doqServer struct {
+	handler  dns_handler.Handler
+	closingC <-chan struct{} // new connections are refused once it is closed
+	logger   *zap.Logger
+
+	l            quic.EarlyListener // closed by Close
+	lastResponse int64              // unix nano, atomic
+}
+
+// serve accepts DoQ connections from s.l. It always returns a non-nil error.
+func (s *doqServer) serve() error {
+	for {
+		c, err := s.l.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		select {
+		case <-s.closingC:
+			c.CloseWithError(doqNoError, "server is shutting down")
+			continue
+		default:
+		}
+		go s.handleConn(c)
+	}
+}
+
+func (s *doqServer) handleConn(c quic.EarlyConnection) {
+	defer c.CloseWithError(doqNoError, "")
+
+	meta := new(handler.RequestMeta)
+	if clientIP := utils.GetIPFromAddr(c.RemoteAddr()); clientIP != nil {
+		meta.ClientIP = clientIP
+	} else {
+		s.logger.Warn("failed to acquire client ip addr")
+	}
+
+	for {
+		stream, err := c.AcceptStream(context.Background())
+		if err != nil {
+			return // connection closed or idle timeout
+		}
+		go s.handleStream(c, stream, meta)
+	}
+}
+
+// handleStream handles a single query. RFC 9250 requires one query per stream,
+// both query and response are prefixed with a 2-byte length field.
+func (s *doqServer) handleStream(c quic.Connection, stream quic.Stream, meta *handler.RequestMeta) {
+	defer stream.Close()
+
+	stream.SetReadDeadline(time.Now().Add(doqStreamReadTimeout))
+	req, _, err := dnsutils.ReadMsgFromTCP(stream)
+	if err != nil {
+		stream.CancelRead(quic.StreamErrorCode(doqProtocolError))
+		return
+	}
+
+	// The message id must be 0. See RFC 9250 4.2.1.
+	if req.Id != 0 {
+		c.CloseWithError(doqProtocolError, "non-zero message id")
+		return
+	}
+
+	if err := s.handler.ServeDNS(c.Context(), req, &doqResponseWriter{s: s, stream: stream}, meta); err != nil {
+		s.logger.Warn("handler err", zap.Error(err))
+		c.CloseWithError(doqInternalError, "")
+	}
+}
+
+// Close closes the listener and all its connections. It waits for
+// doqCloseLinger after the last response, so that it can be sent.
+func (s *doqServer) Close() error {
+	last := time.Unix(0, atomic.LoadInt64(&s.lastResponse))
+	if d := time.Until(last.Add(doqCloseLinger)); d > 0 {
+		time.Sleep(d)
+	}
+	return s.l.Close()
+}
+
+type doqResponseWriter struct {
+	s      *doqServer
+	stream quic.Stream
+}
+
+func (w *doqResponseWriter) Write(m *dns.Msg) error {
+	w.stream.SetWriteDeadline(time.Now().Add(doqStreamWriteTimeout))
+	_, err := dnsutils.WriteMsgToTCP(w.stream, m)
+	atomic.StoreInt64(&w.s.lastResponse, time.Now().UnixNano())
+	return err
+}
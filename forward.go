@@ -0,0 +1,163 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/bundled_upstream"
+	fastforward "github.com/IrineSistiana/mosdns/v3/dispatcher/plugin/executable/fast_forward"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// forward forwards queries to its upstreams concurrently with the
+// bundled_upstream of mosdns, like the fast_forward plugin. Latencies and
+// errors of each upstream are recorded in the metrics.
+type forward struct {
+	*handler.BP
+	mark      uint // route mark, see markRouteLocal
+	upstreams []*upstreamNode
+	bu        *bundled_upstream.BundledUpstream
+}
+
+var _ handler.ExecutablePlugin = (*forward)(nil)
+
+// newForward creates a forward with tag. Queries forwarded by it will be
+// marked with mark. The first upstream is trusted.
+func newForward(o *Opt, tag string, mark uint, upstreams []string) (_ *forward, err error) {
+	f := &forward{BP: handler.NewBP(tag, fastforward.PluginType), mark: mark}
+	defer func() {
+		if err != nil {
+			f.Shutdown()
+		}
+	}()
+
+	var us []bundled_upstream.Upstream
+	for i, s := range upstreams {
+		args, err := initFastForwardArgs(o, []string{s})
+		if err != nil {
+			return nil, err
+		}
+		p, err := fastforward.Init(handler.NewBP(tag, fastforward.PluginType), args)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init upstream [%s], %w", s, err)
+		}
+		u := &upstreamNode{
+			group:   tag,
+			addr:    s,
+			trusted: i == 0,
+			p:       p.(handler.ExecutablePlugin),
+		}
+		f.upstreams = append(f.upstreams, u)
+		us = append(us, u)
+	}
+	if len(f.upstreams) == 0 {
+		return nil, errors.New("no upstream is configured")
+	}
+	f.bu = bundled_upstream.NewBundledUpstream(us, f.L())
+	return f, nil
+}
+
+func (f *forward) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	r, from, err := f.exchange(ctx, qCtx)
+	if err != nil {
+		qCtx.SetResponse(nil, handler.ContextStatusServerFailed)
+		return err
+	}
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	qCtx.AddMark(f.mark)
+	if info := getQueryInfo(ctx); info != nil {
+		info.setUpstream(f.mark, from)
+	}
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+type exchangeTraceKey struct{}
+
+// exchangeTrace records the upstreams that the responses of an exchange
+// came from.
+type exchangeTrace struct {
+	mu   sync.Mutex
+	from map[*dns.Msg]string
+}
+
+// exchange sends the query to the upstreams. It also returns the address
+// of the upstream that the response came from.
+func (f *forward) exchange(ctx context.Context, qCtx *handler.Context) (*dns.Msg, string, error) {
+	t := &exchangeTrace{from: make(map[*dns.Msg]string)}
+	r, err := f.bu.ExchangeParallel(context.WithValue(ctx, exchangeTraceKey{}, t), qCtx)
+	if err != nil {
+		return nil, "", err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return r, t.from[r], nil
+}
+
+// Shutdown closes all upstreams.
+func (f *forward) Shutdown() error {
+	for _, u := range f.upstreams {
+		u.p.Shutdown()
+	}
+	return nil
+}
+
+// upstreamNode is an upstream of a forward. It is a fast_forward plugin
+// that has only one upstream, so all the upstream protocols of fast_forward
+// are supported.
+type upstreamNode struct {
+	group   string
+	addr    string
+	trusted bool
+	p       handler.ExecutablePlugin
+}
+
+var _ bundled_upstream.Upstream = (*upstreamNode)(nil)
+
+func (u *upstreamNode) Address() string {
+	return u.addr
+}
+
+func (u *upstreamNode) Trusted() bool {
+	return u.trusted
+}
+
+func (u *upstreamNode) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	qCtx := handler.NewContext(q, nil)
+	start := time.Now()
+	err := u.p.Exec(ctx, qCtx, nil)
+	if err == nil && qCtx.R() == nil {
+		err = errors.New("no response")
+	}
+	if err != nil {
+		upstreamErrorsTotal.WithLabelValues(u.group, u.addr).Inc()
+		return nil, err
+	}
+	upstreamDuration.WithLabelValues(u.group, u.addr).Observe(time.Since(start).Seconds())
+	r := qCtx.R()
+	if t, ok := ctx.Value(exchangeTraceKey{}).(*exchangeTrace); ok {
+		t.mu.Lock()
+		t.from[r] = u.addr
+		t.mu.Unlock()
+	}
+	return r, nil
+}
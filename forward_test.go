@@ -0,0 +1,65 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func Test_forward_exchange(t *testing.T) {
+	nx := newTestDNSServer(t, func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeNameError)
+		return r
+	})
+	ok := newTestDNSServer(t, answerRR("x. 60 IN A 1.2.3.4"))
+
+	tests := []struct {
+		name      string
+		upstreams []string
+		rcode     int
+		from      string
+	}{
+		{"single", []string{"udp://" + ok.addr}, dns.RcodeSuccess, "udp://" + ok.addr},
+		{"trusted nxdomain", []string{"udp://" + nx.addr}, dns.RcodeNameError, "udp://" + nx.addr},
+		// error rcodes of untrusted upstreams are accepted only if
+		// there is no other response
+		{"untrusted nxdomain", []string{"udp://" + ok.addr, "udp://" + nx.addr}, dns.RcodeSuccess, "udp://" + ok.addr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := newForward(&Opt{}, "test", markRouteUpstream, tt.upstreams)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Shutdown()
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			r, from, err := f.exchange(context.Background(), handler.NewContext(q, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != tt.rcode || from != tt.from {
+				t.Fatalf("got rcode %d from %s, want %d from %s", r.Rcode, from, tt.rcode, tt.from)
+			}
+		})
+	}
+}
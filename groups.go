@@ -0,0 +1,85 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/executable_seq"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/msg_matcher"
+	"strings"
+)
+
+// splitGroupArg splits s in the format "name=value".
+func splitGroupArg(s string) (name, value string, ok bool) {
+	name, value, ok = strings.Cut(s, "=")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	return name, value, ok && len(name) > 0 && len(value) > 0
+}
+
+// parseUpstreamGroups parses upstream groups from ss. Each element of ss
+// is in the format "group=upstream". Upstreams of a group are in order
+// of their appearance, the first one is trusted.
+func parseUpstreamGroups(ss []string) (map[string][]string, error) {
+	groups := make(map[string][]string)
+	for _, s := range ss {
+		name, upstream, ok := splitGroupArg(s)
+		if !ok {
+			return nil, fmt.Errorf("invalid upstream group %s", s)
+		}
+		groups[name] = append(groups[name], upstream)
+	}
+	return groups, nil
+}
+
+// buildForwardRules builds the executables that forward domains of the
+// forward rules in o to their upstream groups. Each rule is in the format
+// "group=domain_file". Rules are matched in order.
+func (b *chainBuilder) buildForwardRules(o *Opt, prefix string) ([]handler.Executable, error) {
+	groups, err := parseUpstreamGroups(o.UpstreamGroup)
+	if err != nil {
+		return nil, err
+	}
+	var route []handler.Executable
+	for _, s := range o.ForwardRule {
+		name, file, ok := splitGroupArg(s)
+		if !ok {
+			return nil, fmt.Errorf("invalid forward rule %s", s)
+		}
+		upstreams, ok := groups[name]
+		if !ok {
+			return nil, fmt.Errorf("forward rule %s has an unknown upstream group %s", s, name)
+		}
+		f, err := b.forward("group/"+name, markRouteGroup, upstreams)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init upstream group %s, %w", name, err)
+		}
+		set, err := b.domainSet(prefix+"forward_rule/"+name, []string{file})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load forward rule %s, %w", s, err)
+		}
+
+		innerNode := handler.WrapExecutable(f)
+		innerNode.LinkNext(handler.WrapExecutable(&end{}))
+		route = append(route, &executable_seq.IfNode{
+			ConditionMatcher: msg_matcher.NewQNameMatcher(set),
+			ExecutableNode:   innerNode,
+		})
+	}
+	return route, nil
+}
@@ -0,0 +1,133 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_splitGroupArg(t *testing.T) {
+	for _, tt := range []struct {
+		s, name, value string
+		ok             bool
+	}{
+		{"office=corp.txt", "office", "corp.txt", true},
+		{" office = https://example.com/corp.txt ", "office", "https://example.com/corp.txt", true},
+		{"office=https://example.com/a?b=c", "office", "https://example.com/a?b=c", true},
+		{"corp.txt", "corp.txt", "", false},
+		{"=corp.txt", "", "corp.txt", false},
+		{"office=", "office", "", false},
+	} {
+		name, value, ok := splitGroupArg(tt.s)
+		if name != tt.name || value != tt.value || ok != tt.ok {
+			t.Errorf("splitGroupArg(%q) = %q, %q, %v, want %q, %q, %v", tt.s, name, value, ok, tt.name, tt.value, tt.ok)
+		}
+	}
+}
+
+func Test_parseUpstreamGroups(t *testing.T) {
+	groups, err := parseUpstreamGroups([]string{
+		"office=udp://10.0.0.1",
+		"home=udp://192.168.1.1",
+		"office=tls://dns.corp.example",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"office": {"udp://10.0.0.1", "tls://dns.corp.example"},
+		"home":   {"udp://192.168.1.1"},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Fatalf("got %v, want %v", groups, want)
+	}
+	if _, err := parseUpstreamGroups([]string{"udp://10.0.0.1"}); err == nil {
+		t.Fatal("want an error for a group without a name")
+	}
+}
+
+func Test_buildForwardRules(t *testing.T) {
+	office := newTestDNSServer(t, answerRR("x. 60 IN A 10.0.0.10"))
+	home := newTestDNSServer(t, answerRR("x. 60 IN A 192.168.1.10"))
+	def := newTestDNSServer(t, answerRR("x. 60 IN A 93.184.216.34"))
+
+	dir := t.TempDir()
+	officeFile := filepath.Join(dir, "office.txt")
+	homeFile := filepath.Join(dir, "home.txt")
+	if err := os.WriteFile(officeFile, []byte("domain:corp.example\nfull:shared.lan\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(homeFile, []byte("domain:lan\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	o := &Opt{
+		Upstream:      []string{"udp://" + def.addr},
+		UpstreamGroup: []string{"office=udp://" + office.addr, "home=udp://" + home.addr},
+		ForwardRule:   []string{"office=" + officeFile, "home=" + homeFile},
+	}
+	chain := buildTestChain(t, o)
+
+	tests := []struct {
+		name   string
+		want   string
+		server *testDNSServer
+	}{
+		{"www.corp.example.", "10.0.0.10", office},
+		{"nas.lan.", "192.168.1.10", home},
+		{"shared.lan.", "10.0.0.10", office}, // rules are matched in order
+		{"example.com.", "93.184.216.34", def},
+	}
+	for _, tt := range tests {
+		counts := map[*testDNSServer]int{office: office.count(), home: home.count(), def: def.count()}
+		r := execQuery(t, chain, nil, tt.name, dns.TypeA)
+		if r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != tt.want {
+			t.Fatalf("%s: unexpected reply %v", tt.name, r)
+		}
+		for s, n := range counts {
+			want := n
+			if s == tt.server {
+				want++
+			}
+			if s.count() != want {
+				t.Fatalf("%s: upstream %s got %d queries, want %d", tt.name, s.addr, s.count()-n, want-n)
+			}
+		}
+	}
+}
+
+func Test_buildForwardRules_invalid(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "office.txt")
+	if err := os.WriteFile(p, []byte("domain:corp.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for name, o := range map[string]*Opt{
+		"unknown group": {UpstreamGroup: []string{"office=udp://10.0.0.1"}, ForwardRule: []string{"home=" + p}},
+		"invalid rule":  {UpstreamGroup: []string{"office=udp://10.0.0.1"}, ForwardRule: []string{p}},
+		"invalid group": {UpstreamGroup: []string{"udp://10.0.0.1"}, ForwardRule: []string{"office=" + p}},
+	} {
+		b := newChainBuilder(o)
+		if _, err := b.buildForwardRules(o, ""); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+		(&entry{plugins: b.plugins}).shutdown(nil)
+	}
+}
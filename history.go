@@ -0,0 +1,376 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	historyFlushInterval   = time.Second
+	historyCleanupInterval = time.Hour
+	historyLockTimeout     = time.Second
+	historyMaxPending      = 100000
+	historyMaxCleanup      = 100000 // max records deleted in one transaction
+)
+
+var historyBucket = []byte("queries")
+
+// openHistoryDB opens the query history database. bbolt locks the file,
+// a database opened for writing can not be opened by other processes.
+//
+// bbolt is used instead of SQLite because the pure-Go SQLite port has no
+// mips and mipsle builds, which are release targets of mosdns-cn, and the
+// history only needs time ordered keys.
+func openHistoryDB(file string, readOnly bool) (*bolt.DB, error) {
+	return bolt.Open(file, 0644, &bolt.Options{Timeout: historyLockTimeout, ReadOnly: readOnly})
+}
+
+// historyKey returns the database key of a record. Keys are sorted by time.
+func historyKey(t time.Time, seq uint32) []byte {
+	k := make([]byte, 12)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(k[8:], seq)
+	return k
+}
+
+// historySink stores query records to the query history database.
+// Records are written in batches. The database is kept open until the
+// sink is closed, so it is searched by the admin api while mosdns-cn
+// is running, see search.
+type historySink struct {
+	db        *bolt.DB
+	retention time.Duration
+
+	m           sync.Mutex
+	pending     []*queryRecord
+	seq         uint32
+	lastCleanup time.Time
+
+	closeOnce sync.Once
+	closeC    chan struct{}
+	done      chan struct{}
+}
+
+var _ queryLogSink = (*historySink)(nil)
+
+func newHistorySink(file string, retention time.Duration) (*historySink, error) {
+	db, err := openHistoryDB(file, false)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &historySink{
+		db:        db,
+		retention: retention,
+		closeC:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *historySink) Write(rec *queryRecord) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.pending) >= historyMaxPending {
+		return errors.New("too many records are waiting to be written to the history database")
+	}
+	s.pending = append(s.pending, rec)
+	return nil
+}
+
+func (s *historySink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(historyFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.closeC:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush writes pending records to the database and deletes expired
+// records.
+func (s *historySink) flush() {
+	s.m.Lock()
+	recs := s.pending
+	s.pending = nil
+	s.m.Unlock()
+	cleanup := time.Since(s.lastCleanup) > historyCleanupInterval
+	if len(recs) == 0 && !cleanup {
+		return
+	}
+
+	if err := s.write(recs, cleanup); err != nil {
+		mlog.S().Warnf("failed to write query history, %v", err)
+		return
+	}
+	if cleanup {
+		s.lastCleanup = time.Now()
+	}
+}
+
+func (s *historySink) write(recs []*queryRecord, cleanup bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			v, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			s.seq++
+			if err := b.Put(historyKey(rec.Time, s.seq), v); err != nil {
+				return err
+			}
+		}
+
+		if cleanup && s.retention > 0 {
+			minKey := historyKey(time.Now().Add(-s.retention), 0)
+			var expired [][]byte
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, minKey) < 0 && len(expired) < historyMaxCleanup; k, _ = c.Next() {
+				expired = append(expired, k)
+			}
+			for _, k := range expired {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// search returns the latest records that match f, see searchHistoryDB.
+func (s *historySink) search(f *historyFilter) ([]*queryRecord, error) {
+	return searchHistoryDB(s.db, f)
+}
+
+// Close writes pending records to the database and closes it.
+func (s *historySink) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closeC)
+		<-s.done
+		err = s.db.Close()
+	})
+	return err
+}
+
+// historyFilter filters query history records.
+type historyFilter struct {
+	client string
+	domain string    // domain or glob pattern, see matchDomainPattern
+	since  time.Time // zero value means no limit
+	until  time.Time
+	limit  int
+}
+
+// newHistoryFilter returns a filter. since and until are parsed by
+// parseHistoryTime, they can be empty.
+func newHistoryFilter(client, domain, since, until string, limit int) (*historyFilter, error) {
+	f := &historyFilter{
+		client: client,
+		domain: domain,
+		until:  time.Now(),
+		limit:  limit,
+	}
+	var err error
+	if len(since) > 0 {
+		if f.since, err = parseHistoryTime(since); err != nil {
+			return nil, err
+		}
+	}
+	if len(until) > 0 {
+		if f.until, err = parseHistoryTime(until); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *historyFilter) match(rec *queryRecord) bool {
+	if len(f.client) > 0 && rec.Client != f.client {
+		return false
+	}
+	if len(f.domain) > 0 && !matchDomainPattern(f.domain, rec.QName) {
+		return false
+	}
+	return true
+}
+
+// matchDomainPattern reports whether qname matches pattern. If pattern
+// contains '*', it is a glob pattern. e.g. "*.example.*". Otherwise
+// pattern matches the domain and all its subdomains.
+func matchDomainPattern(pattern, qname string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	name := strings.ToLower(strings.TrimSuffix(qname, "."))
+	if strings.Contains(pattern, "*") {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+	return name == pattern || strings.HasSuffix(name, "."+pattern)
+}
+
+// searchHistory opens the database file read-only and searches it, see
+// searchHistoryDB. It fails if mosdns-cn is running with the file.
+func searchHistory(file string, f *historyFilter) ([]*queryRecord, error) {
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+	db, err := openHistoryDB(file, true)
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, errors.New("the database is opened by a running mosdns-cn, search it by the admin api /api/history")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return searchHistoryDB(db, f)
+}
+
+// searchHistoryDB returns the latest records in db that match f, in
+// time order.
+func searchHistoryDB(db *bolt.DB, f *historyFilter) ([]*queryRecord, error) {
+	var recs []*queryRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		if b == nil {
+			return nil
+		}
+		var minKey []byte // no lower limit
+		if !f.since.IsZero() {
+			minKey = historyKey(f.since, 0)
+		}
+		maxKey := historyKey(f.until, 0)
+		c := b.Cursor()
+
+		// search backward from until.
+		k, v := c.Seek(maxKey)
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil && bytes.Compare(k, minKey) >= 0; k, v = c.Prev() {
+			rec := new(queryRecord)
+			if err := json.Unmarshal(v, rec); err != nil {
+				return fmt.Errorf("invalid record, %w", err)
+			}
+			if !f.match(rec) {
+				continue
+			}
+			recs = append(recs, rec)
+			if f.limit > 0 && len(recs) >= f.limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(recs)-1; i < j; i, j = i+1, j-1 {
+		recs[i], recs[j] = recs[j], recs[i]
+	}
+	return recs, nil
+}
+
+// parseHistoryTime parses s as a time. s can be a duration before now,
+// e.g. "24h", a RFC 3339 time, or a local time in format "2006-01-02"
+// or "2006-01-02 15:04:05".
+func parseHistoryTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time [%s]", s)
+}
+
+// queryHistory searches the query history database with the filters in o
+// and prints the records to w.
+func queryHistory(o *Opt, w io.Writer) error {
+	if len(o.HistoryDB) == 0 {
+		return errors.New("missing history database, use --history-db")
+	}
+	f, err := newHistoryFilter(o.HistoryClient, o.HistoryDomain, o.HistorySince, o.HistoryUntil, o.HistoryLimit)
+	if err != nil {
+		return err
+	}
+	recs, err := searchHistory(o.HistoryDB, f)
+	if err != nil {
+		return fmt.Errorf("failed to search query history, %w", err)
+	}
+
+	if o.HistoryFormat == "json" {
+		e := json.NewEncoder(w)
+		for _, rec := range recs {
+			if err := e.Encode(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tCLIENT\tQNAME\tQTYPE\tRCODE\tROUTE\tLATENCY\tANSWERS")
+	for _, rec := range recs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%sms\t%s\n",
+			rec.Time.Local().Format("2006-01-02 15:04:05"),
+			rec.Client,
+			rec.QName,
+			rec.QType,
+			rec.RCode,
+			rec.Route,
+			strconv.FormatFloat(rec.Latency, 'f', -1, 64),
+			strings.Join(rec.Answers, ","),
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,126 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_historySink(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.db")
+	s, err := newHistorySink(file, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Now()
+	for _, rec := range []*queryRecord{
+		{Time: now.Add(-2 * time.Hour), Client: "192.168.1.40", QName: "expired.example.com.", QType: "A"},
+		{Time: now.Add(-30 * time.Minute), Client: "192.168.1.40", QName: "www.example.com.", QType: "A"},
+		{Time: now.Add(-20 * time.Minute), Client: "192.168.1.41", QName: "www.example.org.", QType: "AAAA"},
+		{Time: now.Add(-10 * time.Minute), Client: "192.168.1.40", QName: "api.example.com.", QType: "A"},
+	} {
+		if err := s.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(client, domain, since string, limit int) []string {
+		t.Helper()
+		f, err := newHistoryFilter(client, domain, since, "", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs, err := s.search(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, rec := range recs {
+			names = append(names, rec.QName)
+		}
+		return names
+	}
+	// records are written in the next flush, which also deletes the
+	// expired ones.
+	deadline := time.Now().Add(5 * historyFlushInterval)
+	for len(search("", "", "", 0)) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("records are not flushed, got %v", search("", "", "", 0))
+		}
+		time.Sleep(historyFlushInterval / 10)
+	}
+	for _, tt := range []struct {
+		client, domain, since string
+		limit                 int
+		want                  string
+	}{
+		{"", "", "", 0, "www.example.com. www.example.org. api.example.com."},
+		{"192.168.1.40", "", "", 0, "www.example.com. api.example.com."},
+		{"", "example.com", "", 0, "www.example.com. api.example.com."},
+		{"", "www.example.*", "", 0, "www.example.com. www.example.org."},
+		{"", "", "15m", 0, "api.example.com."},
+		{"", "", "", 2, "www.example.org. api.example.com."}, // the latest ones
+	} {
+		if got := strings.Join(search(tt.client, tt.domain, tt.since, tt.limit), " "); got != tt.want {
+			t.Errorf("client %q, domain %q, since %q, limit %d: got %q, want %q", tt.client, tt.domain, tt.since, tt.limit, got, tt.want)
+		}
+	}
+
+	// the database is kept open, it is searched by the admin api.
+	if _, err := searchHistory(file, &historyFilter{until: now}); err == nil || !strings.Contains(err.Error(), "/api/history") {
+		t.Fatalf("want an error that the database is opened, got %v", err)
+	}
+	a := &adminAPI{history: s}
+	w := httptest.NewRecorder()
+	a.handleHistory(w, httptest.NewRequest(http.MethodGet, "/api/history?client=192.168.1.41", nil))
+	var recs []*queryRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &recs); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if len(recs) != 1 || recs[0].QName != "www.example.org." {
+		t.Fatalf("unexpected records %v", recs)
+	}
+	w = httptest.NewRecorder()
+	a.handleHistory(w, httptest.NewRequest(http.MethodGet, "/api/history?since=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d", w.Code)
+	}
+
+	// pending records are written on close, then the file can be opened.
+	if err := s.Write(&queryRecord{Time: now, Client: "192.168.1.42", QName: "last.example.com.", QType: "A"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := searchHistory(file, &historyFilter{until: now.Add(time.Second), limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].QName != "last.example.com." {
+		t.Fatalf("unexpected records %v", got)
+	}
+}
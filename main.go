@@ -18,29 +18,27 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/executable_seq"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/load_cache"
-	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/elem"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/msg_matcher"
-	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
 	_ "github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/v2data"
-	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/plugin/executable/cache"
 	fastforward "github.com/IrineSistiana/mosdns/v3/dispatcher/plugin/executable/fast_forward"
-	"github.com/IrineSistiana/mosdns/v3/dispatcher/plugin/executable/hosts"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/plugin/executable/ttl"
 	"github.com/jessevdk/go-flags"
 	"github.com/kardianos/service"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v3"
-	"net"
+	"io"
 	"net/url"
 	"os"
 	"os/signal"
@@ -49,26 +47,63 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 var version = "dev/unknown"
 
 type Opt struct {
-	ConfigFile        string   `long:"config" description:"Load settings from the yaml file" yaml:"-"`
-	ServerAddr        string   `short:"s" long:"server" description:"Server address" yaml:"server_addr"`
-	CacheSize         int      `short:"c" long:"cache" description:"Cache size"  yaml:"cache_size"`
-	LazyCacheTTL      int      `long:"lazy-cache-ttl" description:"Responses will stay in the cache for configured seconds." yaml:"lazy_cache_ttl"`
-	LazyCacheReplyTTL int      `long:"lazy-cache-reply-ttl" description:"TTL value to use when replying with expired data." yaml:"lazy_cache_reply_ttl"`
-	RedisCache        string   `long:"redis-cache" description:"Redis cache backend." yaml:"redis_cache"`
-	MinTTL            uint32   `long:"min-ttl" description:"Minimum TTL value for DNS responses" yaml:"min_ttl"`
-	MaxTTL            uint32   `long:"max-ttl" description:"Maximum TTL value for DNS responses" yaml:"max_ttl"`
-	Hosts             []string `long:"hosts" description:"Hosts" yaml:"hosts"`
-	BlacklistDomain   []string `long:"blacklist-domain" description:"Blacklist domain" yaml:"blacklist_domain"`
-	Insecure          bool     `long:"insecure" description:"Disable TLS certificate validation" yaml:"insecure"`
-	CA                []string `long:"ca" description:"CA files" yaml:"ca"`
-	Debug             bool     `short:"v" long:"debug" description:"Verbose log" yaml:"debug"`
-	LogFile           string   `long:"log-file" description:"Write logs to a file" yaml:"log_file"`
+	ConfigFile        string      `long:"config" description:"Load settings from the yaml file" yaml:"-"`
+	ServerAddr        listenAddrs `short:"s" long:"server" description:"Server address" yaml:"server_addr"`
+	TLSServerAddr     listenAddrs `long:"tls-server" description:"DoT server address" yaml:"tls_server_addr"`
+	DoHServerAddr     listenAddrs `long:"doh-server" description:"DoH server address" yaml:"doh_server_addr"`
+	DoHPath           string      `long:"doh-path" description:"DoH server url path" default:"/dns-query" yaml:"doh_path"`
+	DoHPlainHTTP      bool        `long:"doh-plain-http" description:"Serve DoH over plain HTTP, client ip is read from X-Forwarded-For" yaml:"doh_plain_http"`
+	TrustedProxy      []string    `long:"trusted-proxy" description:"Only read X-Forwarded-For from these reverse proxies" yaml:"trusted_proxy"`
+	DoQServerAddr     listenAddrs `long:"doq-server" description:"DoQ server address" yaml:"doq_server_addr"`
+	Cert              string      `long:"cert" description:"Certificate file for the DoT/DoH/DoQ server" yaml:"cert"`
+	Key               string      `long:"key" description:"Key file for the DoT/DoH/DoQ server" yaml:"key"`
+	CacheSize         int         `short:"c" long:"cache" description:"Cache size"  yaml:"cache_size"`
+	LazyCacheTTL      int         `long:"lazy-cache-ttl" description:"Responses will stay in the cache for configured seconds." yaml:"lazy_cache_ttl"`
+	LazyCacheReplyTTL int         `long:"lazy-cache-reply-ttl" description:"TTL value to use when replying with expired data." yaml:"lazy_cache_reply_ttl"`
+	RedisCache        string      `long:"redis-cache" description:"Redis cache backend." yaml:"redis_cache"`
+	MinTTL            uint32      `long:"min-ttl" description:"Minimum TTL value for DNS responses" yaml:"min_ttl"`
+	MaxTTL            uint32      `long:"max-ttl" description:"Maximum TTL value for DNS responses" yaml:"max_ttl"`
+	AllowClient       []string    `long:"allow-client" description:"Only accept queries from these client ips" yaml:"allow_client"`
+	DenyClient        []string    `long:"deny-client" description:"Reject queries from these client ips" yaml:"deny_client"`
+	ClientReject      string      `long:"client-reject-action" description:"Action for rejected clients" choice:"refused" choice:"drop" default:"refused" yaml:"client_reject_action"`
+	Hosts             []string    `long:"hosts" description:"Hosts" yaml:"hosts"`
+	Records           []string    `long:"records" description:"Local records files in the zone file format" yaml:"records"`
+	Zone              []string    `long:"zone" description:"Authoritative zone files" yaml:"zone"`
+	BlacklistDomain   []string    `long:"blacklist-domain" description:"Blacklist domain" yaml:"blacklist_domain"`
+	WhitelistDomain   []string    `long:"whitelist-domain" description:"Domains that are exempted from the blacklist" yaml:"whitelist_domain"`
+	BlockResponse     string      `long:"block-response" description:"Response to blocked queries: nxdomain, nodata, refused, zero-ip, drop or ip addresses like '10.0.0.1,fd00::1'" default:"nxdomain" yaml:"block_response"`
+	BlockTTL          uint32      `long:"block-ttl" description:"TTL of the block response" default:"300" yaml:"block_ttl"`
+	BlockSOA          bool        `long:"block-soa" description:"Add a SOA record to negative block responses for negative caching" yaml:"block_soa"`
+	SafeSearch        bool        `long:"safe-search" description:"Rewrite search engines to their safe search domains" yaml:"safe_search"`
+	SafeSearchFile    []string    `long:"safe-search-file" description:"Files that override the built-in safe search table" yaml:"safe_search_file"`
+	WatchFiles        bool        `long:"watch-files" description:"Reload domain, ip and hosts files automatically when they are changed" yaml:"watch_files"`
+	RemoteCacheDir    string      `long:"remote-cache-dir" description:"Dir to store downloaded rule files" default:"remote_cache" yaml:"remote_cache_dir"`
+	RemoteRefresh     int         `long:"remote-refresh" description:"Interval in seconds to update downloaded rule files, 0 disables updating" default:"86400" yaml:"remote_refresh"`
+	Insecure          bool        `long:"insecure" description:"Disable TLS certificate validation" yaml:"insecure"`
+	CA                []string    `long:"ca" description:"CA files" yaml:"ca"`
+	Debug             bool        `short:"v" long:"debug" description:"Verbose log" yaml:"debug"`
+	LogFile           string      `long:"log-file" description:"Write logs to a file" yaml:"log_file"`
+	MetricsAddr       string      `long:"metrics-addr" description:"Prometheus metrics server address" yaml:"metrics_addr"`
+	AdminAddr         string      `long:"admin-addr" description:"Admin api server address, binds to localhost if the host is omitted" yaml:"admin_addr"`
+	AdminToken        string      `long:"admin-token" description:"Bearer token required by the admin api" yaml:"admin_token"`
+	Dashboard         bool        `long:"dashboard" description:"Serve the web dashboard on the admin server" yaml:"dashboard"`
+	QueryLog          []string    `long:"query-log" description:"Write query logs in JSON lines to stdout or files" yaml:"query_log"`
+	QueryLogMaxSize   int         `long:"query-log-max-size" description:"Max size in megabytes of a query log file before it gets rotated" default:"100" yaml:"query_log_max_size"`
+	QueryLogMaxBackup int         `long:"query-log-max-backups" description:"Max number of rotated query log files to keep" default:"3" yaml:"query_log_max_backups"`
+	HistoryDB         string      `long:"history-db" description:"Store the query history in the database file" yaml:"history_db"`
+	HistoryRetention  int         `long:"history-retention" description:"Days to keep the query history" default:"7" yaml:"history_retention"`
+	ShutdownTimeout   int         `long:"shutdown-timeout" description:"Max seconds to wait for in-flight queries on shutdown" default:"5" yaml:"shutdown_timeout"`
+
+	// per-client profiles
+	Profiles []Profile `yaml:"profiles"`
 
 	// simple forwarder
 	Upstream []string `long:"upstream" description:"Upstream" yaml:"upstream"`
@@ -76,11 +111,19 @@ type Opt struct {
 	// local/remote forwarder
 	LocalUpstream  []string `long:"local-upstream" description:"Local upstream" yaml:"local_upstream"` // required if Upstream is empty
 	LocalIP        []string `long:"local-ip" description:"Local ip" yaml:"local_ip"`
+	LocalIPQtype   []string `long:"local-ip-qtype" description:"Query types that are diverted by the local ip, others go to the local upstream" default:"A" default:"AAAA" yaml:"local_ip_qtype"`
 	LocalDomain    []string `long:"local-domain" description:"Local domain" yaml:"local_domain"`
 	LocalLatency   int      `long:"local-latency" description:"Local latency in milliseconds" default:"50" yaml:"local_latency"`
 	RemoteUpstream []string `long:"remote-upstream" description:"Remote upstream" yaml:"remote_upstream"` // required if Upstream is empty
 	RemoteDomain   []string `long:"remote-domain" description:"Remote domain" yaml:"remote_domain"`
 
+	// upstream groups, matched before the forwarders above
+	UpstreamGroup []string `long:"upstream-group" description:"Named upstream group, format: group=upstream" yaml:"upstream_group"`
+	ForwardRule   []string `long:"forward-rule" description:"Forward domains to an upstream group, format: group=domain_file" yaml:"forward_rule"`
+
+	// reverse lookups of private addresses, answered locally if omitted
+	PrivatePTRUpstream []string `long:"private-ptr-upstream" description:"Upstream for reverse lookups of private addresses" yaml:"private_ptr_upstream"`
+
 	WorkingDir   string `long:"dir" description:"Working dir" yaml:"working_dir"`
 	CD2Exe       bool   `long:"cd2exe" description:"Change working dir to executable automatically" yaml:"cd2exe"`
 	Service      string `long:"service" description:"Service control" choice:"install" choice:"uninstall" choice:"start" choice:"stop" choice:"restart" yaml:"-"`
@@ -88,6 +131,15 @@ type Opt struct {
 
 	GenConfig    string `long:"gen-config" description:"Generate a configuration file to the given path" yaml:"-"`
 	PrintVersion bool   `long:"version" description:"Print the program version" yaml:"-"`
+
+	// query history search
+	QueryHistory  bool   `long:"query-history" description:"Search the query history database and exit" yaml:"-"`
+	HistoryClient string `long:"history-client" description:"Search queries from the client ip" yaml:"-"`
+	HistoryDomain string `long:"history-domain" description:"Search queries of the domain and its subdomains, or a pattern with '*'" yaml:"-"`
+	HistorySince  string `long:"history-since" description:"Search queries since the time or the duration ago" yaml:"-"`
+	HistoryUntil  string `long:"history-until" description:"Search queries until the time or the duration ago" yaml:"-"`
+	HistoryFormat string `long:"history-format" description:"Output format" choice:"table" choice:"json" default:"table" yaml:"-"`
+	HistoryLimit  int    `long:"history-limit" description:"Max number of queries to print, 0 means no limit" default:"100" yaml:"-"`
 }
 
 var opt = new(Opt)
@@ -123,28 +175,33 @@ func main() {
 	}
 
 	if cf := opt.ConfigFile; len(cf) > 0 {
-		b, err := os.ReadFile(cf)
-		if err != nil {
-			mlog.S().Fatalf("failed to load configuration file: %v", err)
+		if err := loadConfigFile(opt, cf); err != nil {
+			mlog.S().Fatal(err)
 		}
-		if err := yaml.Unmarshal(b, opt); err != nil {
-			mlog.S().Fatalf("failed to parse configuration file: %v", err)
+		// config file will be reloaded after cd.
+		if opt.ConfigFile, err = filepath.Abs(cf); err != nil {
+			mlog.S().Fatalf("failed to get the absolute path of the configuration file: %v", err)
 		}
 	}
 	cd() // change wd for config arguments
 
-	if opt.Debug {
-		mlog.Level().SetLevel(zap.DebugLevel)
-	} else {
-		mlog.Level().SetLevel(zap.InfoLevel)
+	if opt.QueryHistory {
+		if err := queryHistory(opt, os.Stdout); err != nil {
+			mlog.S().Fatal(err)
+		}
+		os.Exit(0)
 	}
 
+	setLogLevel(opt)
+
 	if len(opt.Service) == 0 && !opt.RunAsService {
-		go run()
+		m := new(svc)
+		m.Start(nil)
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
 		s := <-c
 		mlog.S().Infof("%s, exiting", s)
+		m.Stop(nil)
 		os.Exit(0)
 	}
 
@@ -152,6 +209,7 @@ func main() {
 		Name:        "mosdns-cn",
 		DisplayName: "mosdns-cn",
 		Description: "A DNS forwarder",
+		Option:      service.KeyValue{"ReloadSignal": "HUP"},
 	}
 
 	svc := new(svc)
@@ -200,6 +258,14 @@ func main() {
 	}
 }
 
+func setLogLevel(o *Opt) {
+	if o.Debug {
+		mlog.Level().SetLevel(zap.DebugLevel)
+	} else {
+		mlog.Level().SetLevel(zap.InfoLevel)
+	}
+}
+
 func cd() {
 	var d string
 	switch {
@@ -221,18 +287,31 @@ func cd() {
 	}
 }
 
-type svc struct{}
+type svc struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
 
 func (m *svc) Start(s service.Service) error {
-	go run()
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	go func() {
+		defer close(m.done)
+		run(ctx)
+	}()
 	return nil
 }
 
 func (m *svc) Stop(s service.Service) error {
+	m.cancel()
+	<-m.done
 	return nil
 }
 
-func run() {
+// run starts the servers and blocks until ctx is done and the servers
+// are gracefully shut down.
+func run(ctx context.Context) {
 	if len(opt.LogFile) > 0 {
 		f, err := os.OpenFile(opt.LogFile, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0755)
 		if err != nil {
@@ -246,111 +325,511 @@ func run() {
 	mlog.S().Infof("mosdns-cn ver: %s", version)
 	mlog.S().Infof("arch: %s, os: %s, go: %s", runtime.GOARCH, runtime.GOOS, runtime.Version())
 
-	entry, err := initEntry()
+	e, err := initEntry(opt, nil)
 	if err != nil {
 		mlog.S().Fatalf("failed to init entry, %v", err)
 	}
-	h := &dns_handler.DefaultHandler{
+	entry := newReloadableEntry(e)
+	h := newDrainHandler(&dns_handler.DefaultHandler{
 		Logger: mlog.L().Named("dns_handler"),
-		Entry:  entry,
+		Entry:  handler.WrapExecutable(&queryEntry{next: entry}),
+	})
+	var stats *queryStats // stats for the dashboard
+	var extraSinks []queryLogSink
+	if opt.Dashboard {
+		if len(opt.AdminAddr) == 0 {
+			mlog.S().Fatal("dashboard requires the admin server address")
+		}
+		stats = newQueryStats()
+		extraSinks = append(extraSinks, stats)
+	}
+	queryLog, err = initQueryLog(opt, extraSinks...)
+	if err != nil {
+		mlog.S().Fatalf("failed to init query log, %v", err)
+	}
+
+	var metricsServer io.Closer
+	if len(opt.MetricsAddr) > 0 {
+		s, err := startMetricsServer(opt.MetricsAddr)
+		if err != nil {
+			mlog.S().Fatalf("failed to start metrics server, %v", err)
+		}
+		metricsServer = s
+	}
+
+	var adminServer io.Closer
+	if len(opt.AdminAddr) > 0 {
+		s, err := startAdminServer(opt.AdminAddr, opt.AdminToken, entry, stats, queryLog.history())
+		if err != nil {
+			mlog.S().Fatalf("failed to start admin server, %v", err)
+		}
+		adminServer = s
 	}
 
 	// start servers
 
-	if len(opt.ServerAddr) == 0 {
+	specs, err := listenerSpecs()
+	if err != nil {
+		mlog.S().Fatal(err)
+	}
+	if len(specs) == 0 {
 		mlog.S().Fatal("missing server address")
 	}
-	s := server.Server{
-		DNSHandler: h,
-		Logger:     mlog.L().Named("server"),
+	var tlsConfig *tls.Config
+	for _, ls := range specs {
+		if ls.requireTLS() {
+			tlsConfig, err = loadServerTLSConfig()
+			if err != nil {
+				mlog.S().Fatalf("failed to load server tls config, %v", err)
+			}
+			break
+		}
+	}
+	var servers []io.Closer
+	for _, ls := range specs {
+		s, err := startListener(ls, h, tlsConfig)
+		if err != nil {
+			mlog.S().Fatalf("failed to start listener %s, %v", ls.name, err)
+		}
+		servers = append(servers, s)
+	}
+
+	mlog.S().Info("server started")
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+wait:
+	for {
+		select {
+		case <-hup:
+			reloadConfig(entry)
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	// graceful shutdown
+	mlog.S().Info("shutting down")
+	shutdownTimeout := opt.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = 5
+	}
+	if !h.drain(time.Duration(shutdownTimeout) * time.Second) {
+		mlog.S().Warn("shutdown timeout, some queries are still in processing")
+	}
+	for _, s := range servers {
+		s.Close()
+	}
+	entry.shutdown()
+	if queryLog != nil {
+		queryLog.Close()
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
 	}
-	udpConn, err := net.ListenPacket("udp", opt.ServerAddr)
+	if adminServer != nil {
+		adminServer.Close()
+	}
+	mlog.S().Info("server exited")
+	mlog.L().Sync()
+}
+
+func loadServerTLSConfig() (*tls.Config, error) {
+	if len(opt.Cert) == 0 || len(opt.Key) == 0 {
+		return nil, errors.New("both cert and key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(opt.Cert, opt.Key)
 	if err != nil {
-		mlog.S().Fatalf("failed to listen on udp socket, %v", err)
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// entry is the executable chain built from an Opt.
+type entry struct {
+	handler.ExecutableChainNode
+	plugins []handler.Plugin // plugins that need to be shut down
+
+	opt      *Opt
+	ruleSets []ruleSet
+
+	caches    map[string]*dnsCache // by profile name, "" is the default chain
+	cacheArgs cache.Args
+
+	watcher   *fileWatcher     // nil if watch_files is disabled
+	refresher *remoteRefresher // nil if there is no remote file to refresh
+
+	// in-flight queries, see reloadableEntry.acquire
+	refMu    sync.Mutex
+	inflight int
+	retired  bool
+	drained  chan struct{} // closed when retired and inflight is 0
+}
+
+// stopUpdates stops watching and refreshing the rule files of the entry.
+func (e *entry) stopUpdates() {
+	if e.watcher != nil {
+		e.watcher.Close()
 	}
-	mlog.S().Infof("listening on udp socket %s", udpConn.LocalAddr())
-	l, err := net.Listen("tcp", opt.ServerAddr)
+	if e.refresher != nil {
+		e.refresher.Close()
+	}
+}
+
+// shutdown shuts down plugins of the entry. e.g. closes upstream
+// connections and the redis client. Plugins that are shared with
+// keep will not be shut down. keep can be nil.
+func (e *entry) shutdown(keep *entry) {
+	e.stopUpdates()
+	shared := make(map[handler.Plugin]struct{})
+	if keep != nil {
+		for _, p := range keep.plugins {
+			shared[p] = struct{}{}
+		}
+	}
+	for _, p := range e.plugins {
+		if _, ok := shared[p]; ok {
+			continue
+		}
+		if err := p.Shutdown(); err != nil {
+			mlog.S().Warnf("failed to shutdown %s, %v", p.Tag(), err)
+		}
+	}
+}
+
+// initEntry builds a new entry from o. If prev is not nil, its caches will be
+// reused if the cache settings are not changed.
+func initEntry(o *Opt, prev *entry) (_ *entry, err error) {
+	route := make([]handler.Executable, 0)
+	b := newChainBuilder(o)
+	b.prev = prev
+	defer func() {
+		if err != nil { // shutdown plugins that have been initialized.
+			(&entry{plugins: b.plugins}).shutdown(prev)
+		}
+	}()
+
+	if len(o.AllowClient) > 0 || len(o.DenyClient) > 0 {
+		acl := &clientACL{drop: o.ClientReject == "drop"}
+		if len(o.AllowClient) > 0 {
+			set, err := b.ipSet("allow_client", o.AllowClient)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load allowed client ips, %w", err)
+			}
+			acl.allow = set
+		}
+		if len(o.DenyClient) > 0 {
+			set, err := b.ipSet("deny_client", o.DenyClient)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load denied client ips, %w", err)
+			}
+			acl.deny = set
+		}
+		route = append(route, acl)
+	}
+
+	// names in zones are never forwarded.
+	if len(o.Zone) > 0 {
+		s, err := newZoneSet("zone", o.Zone, b.remote)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init zones, %w", err)
+		}
+		mlog.S().Infof("zone files loaded, total length: %d", s.Len())
+		b.sets = append(b.sets, s)
+		route = append(route, s)
+	}
+
+	// records are before hosts, so CNAME targets can be answered by hosts.
+	if len(o.Records) > 0 {
+		s, err := newRecordsSet("records", o.Records, b.remote)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init records, %w", err)
+		}
+		mlog.S().Infof("records files loaded, total length: %d", s.Len())
+		b.sets = append(b.sets, s)
+		route = append(route, s)
+	}
+
+	cachePlugin, err := b.cache("")
 	if err != nil {
-		mlog.S().Fatalf("failed to listen on tcp socket, %v", err)
+		return nil, err
 	}
-	mlog.S().Infof("listening on tcp socket %s", l.Addr())
-	go func() {
-		err := s.ServeUDP(udpConn)
+	chain, err := b.buildChain(o, "", cachePlugin)
+	if err != nil {
+		return nil, err
+	}
+	if len(o.Profiles) == 0 {
+		route = append(route, chain...)
+	} else {
+		sel, err := b.buildProfiles(o, chain)
 		if err != nil {
-			mlog.S().Fatalf("udp server exited: %v", err)
+			return nil, err
 		}
-	}()
-	go func() {
-		err := s.ServeTCP(l)
+		route = append(route, sel)
+	}
+
+	node, err := parseChain(route)
+	if err != nil {
+		return nil, err
+	}
+
+	var watcher *fileWatcher
+	if o.WatchFiles && len(b.sets) > 0 {
+		watcher, err = newFileWatcher(b.sets)
 		if err != nil {
-			mlog.S().Fatalf("tcp server exited: %v", err)
+			return nil, fmt.Errorf("failed to watch files, %w", err)
 		}
-	}()
+	}
+	var refresher *remoteRefresher
+	if o.RemoteRefresh > 0 {
+		refresher = newRemoteRefresher(b.remote, b.sets, time.Duration(o.RemoteRefresh)*time.Second)
+	}
 
-	mlog.S().Info("server started")
-	select {}
+	load_cache.GetCache().Purge()
+	debug.FreeOSMemory()
+	return &entry{
+		ExecutableChainNode: node,
+		plugins:             b.plugins,
+		opt:                 o,
+		ruleSets:            b.sets,
+		caches:              b.caches,
+		cacheArgs:           b.cacheArgs(),
+		watcher:             watcher,
+		refresher:           refresher,
+	}, nil
+}
+
+// parseChain links executables to a chain.
+func parseChain(route []handler.Executable) (handler.ExecutableChainNode, error) {
+	ii := make([]interface{}, 0, len(route))
+	for _, node := range route {
+		ii = append(ii, node)
+	}
+	node, err := executable_seq.ParseExecutableNode(ii, mlog.L())
+	if err != nil {
+		return nil, fmt.Errorf("inner err, failed to init entry, %w", err)
+	}
+	return node, nil
+}
+
+// chainBuilder builds executables of an entry. Rule sets and upstreams
+// that have the same files or addresses are shared, e.g. by the chains
+// of profiles.
+type chainBuilder struct {
+	o        *Opt
+	prev     *entry // the entry to be replaced, can be nil
+	remote   *remoteCache
+	plugins  []handler.Plugin // plugins that need to be shut down
+	sets     []ruleSet
+	shared   map[string]ruleSet
+	forwards map[string]*forward
+	caches   map[string]*dnsCache
+}
+
+func newChainBuilder(o *Opt) *chainBuilder {
+	return &chainBuilder{
+		o:        o,
+		remote:   newRemoteCache(o.RemoteCacheDir),
+		shared:   make(map[string]ruleSet),
+		forwards: make(map[string]*forward),
+		caches:   make(map[string]*dnsCache),
+	}
+}
+
+// cacheArgs returns the args of caches.
+func (b *chainBuilder) cacheArgs() cache.Args {
+	if b.o.CacheSize <= 0 && len(b.o.RedisCache) == 0 {
+		return cache.Args{}
+	}
+	return cache.Args{
+		Size:              b.o.CacheSize,
+		Redis:             b.o.RedisCache,
+		LazyCacheTTL:      b.o.LazyCacheTTL,
+		LazyCacheReplyTTL: b.o.LazyCacheReplyTTL,
+	}
+}
+
+// cache returns the cache of the profile, "" is the default chain. It
+// returns nil if the cache is disabled. The cache of the replaced entry is
+// kept if the cache settings are not changed. Profiles have their own
+// caches in memory, because responses of different profiles would share
+// the keys in redis.
+func (b *chainBuilder) cache(profile string) (*dnsCache, error) {
+	args := b.cacheArgs()
+	if args == (cache.Args{}) {
+		return nil, nil
+	}
+	if c, ok := b.caches[profile]; ok {
+		return c, nil
+	}
+	var c *dnsCache
+	if b.prev != nil && b.prev.cacheArgs == args {
+		c = b.prev.caches[profile] // keep the cached data
+	}
+	if c == nil {
+		tag := "cache"
+		if len(profile) > 0 {
+			tag = profile + "/cache"
+			args.Redis = ""
+		}
+		var err error
+		if c, err = newDNSCache(handler.NewBP(tag, cache.PluginType), args); err != nil {
+			return nil, fmt.Errorf("failed to init cache, %w", err)
+		}
+	}
+	b.caches[profile] = c
+	b.plugins = append(b.plugins, c)
+	return c, nil
+}
+
+// ruleSet returns the set of kind that loaded from files. It calls newSet
+// to load a new one if there is no such set.
+func (b *chainBuilder) ruleSet(kind string, files []string, newSet func() (ruleSet, error)) (ruleSet, error) {
+	key := kind + "\x00" + strings.Join(files, "\x00")
+	if s, ok := b.shared[key]; ok {
+		return s, nil
+	}
+	s, err := newSet()
+	if err != nil {
+		return nil, err
+	}
+	mlog.S().Infof("%s files loaded, total length: %d", s.Tag(), s.Len())
+	b.shared[key] = s
+	b.sets = append(b.sets, s)
+	return s, nil
+}
+
+func (b *chainBuilder) domainSet(tag string, files []string) (*domainSet, error) {
+	s, err := b.ruleSet("domain", files, func() (ruleSet, error) {
+		return newDomainSet(tag, files, b.remote)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.(*domainSet), nil
+}
+
+func (b *chainBuilder) ipSet(tag string, files []string) (*ipSet, error) {
+	s, err := b.ruleSet("ip", files, func() (ruleSet, error) {
+		return newIPSet(tag, files, b.remote)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.(*ipSet), nil
+}
+
+func (b *chainBuilder) hostsSet(tag string, files []string) (*hostsSet, error) {
+	s, err := b.ruleSet("hosts", files, func() (ruleSet, error) {
+		return newHostsSet(tag, files, b.remote)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.(*hostsSet), nil
 }
 
-// some plugin args require file name start with `ext:`
-func addFilePrefix(ss []string) []string {
-	o := make([]string, 0, len(ss))
-	for _, s := range ss {
-		o = append(o, "ext:"+s)
+// forward returns the forward of upstreams.
+func (b *chainBuilder) forward(tag string, mark uint, upstreams []string) (*forward, error) {
+	key := strconv.Itoa(int(mark)) + "\x00" + strings.Join(upstreams, "\x00")
+	if f, ok := b.forwards[key]; ok {
+		return f, nil
 	}
-	return o
+	f, err := newForward(b.o, tag, mark, upstreams)
+	if err != nil {
+		return nil, err
+	}
+	b.forwards[key] = f
+	b.plugins = append(b.plugins, f)
+	return f, nil
 }
 
-func initEntry() (handler.ExecutableChainNode, error) {
+// buildChain builds the executables of hosts, blacklist, cache and
+// upstreams from o. Tags of rule sets and upstreams have the prefix.
+// cachePlugin can be nil.
+func (b *chainBuilder) buildChain(o *Opt, prefix string, cachePlugin *dnsCache) ([]handler.Executable, error) {
 	route := make([]handler.Executable, 0)
 
-	if len(opt.Hosts) > 0 {
-		p, err := hosts.Init(handler.NewBP("hosts", hosts.PluginType), &hosts.Args{Hosts: addFilePrefix(opt.Hosts)})
+	if len(o.Hosts) > 0 {
+		s, err := b.hostsSet(prefix+"hosts", o.Hosts)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init hosts, %w", err)
 		}
-		route = append(route, p.(handler.Executable))
+		route = append(route, s)
 	}
 
-	if len(opt.BlacklistDomain) > 0 {
-		mixMatcher, err := loadDomainMatcher(opt.BlacklistDomain)
+	if len(o.BlacklistDomain) > 0 {
+		set, err := b.domainSet(prefix+"blacklist_domain", o.BlacklistDomain)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init blacklist, %w", err)
 		}
-		e := &blackList{m: msg_matcher.NewQNameMatcher(mixMatcher)}
-		mlog.S().Infof("black domain files loaded, total length: %d", mixMatcher.Len())
+		resp, err := newBlockResponse(o.BlockResponse, o.BlockTTL, o.BlockSOA)
+		if err != nil {
+			return nil, err
+		}
+		e := &blackList{
+			m:     msg_matcher.NewQNameMatcher(set),
+			allow: []*msg_matcher.QNameMatcher{msg_matcher.NewQNameMatcher(set.exceptions())},
+			resp:  resp,
+		}
+
+		if len(o.WhitelistDomain) > 0 {
+			set, err := b.domainSet(prefix+"whitelist_domain", o.WhitelistDomain)
+			if err != nil {
+				return nil, fmt.Errorf("failed to init whitelist, %w", err)
+			}
+			e.allow = append(e.allow, msg_matcher.NewQNameMatcher(set))
+		}
 		route = append(route, e)
 	}
 
-	if opt.CacheSize > 0 || len(opt.RedisCache) > 0 {
-		p, err := cache.Init(handler.NewBP("cache", cache.PluginType), &cache.Args{
-			Size:              opt.CacheSize,
-			Redis:             opt.RedisCache,
-			LazyCacheTTL:      opt.LazyCacheTTL,
-			LazyCacheReplyTTL: opt.LazyCacheReplyTTL,
-			CacheEverything:   true,
+	if o.SafeSearch {
+		s, err := b.ruleSet("safe_search", o.SafeSearchFile, func() (ruleSet, error) {
+			return newSafeSearch("safe_search", o.SafeSearchFile, b.remote)
 		})
 		if err != nil {
-			return nil, fmt.Errorf("failed to init cache, %w", err)
+			return nil, fmt.Errorf("failed to init safe search, %w", err)
 		}
-		route = append(route, p.(handler.Executable))
+		route = append(route, s.(*safeSearch))
 	}
 
-	// init upstream
-	if len(opt.Upstream) > 0 {
-		args, err := initFastForwardArgs(opt.Upstream)
+	if cachePlugin != nil {
+		route = append(route, cachePlugin)
+	}
+
+	// forward rules go before the diversion
+	if len(o.ForwardRule) > 0 {
+		rules, err := b.buildForwardRules(o, prefix)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse upstream, %w", err)
+			return nil, err
 		}
-		p, err := fastforward.Init(handler.NewBP("upstream", fastforward.PluginType), args)
+		route = append(route, rules...)
+	}
+
+	// reverse lookups of private addresses never go to the upstreams below
+	ptr := new(privatePTR)
+	if len(o.PrivatePTRUpstream) > 0 {
+		p, err := b.forward(prefix+"private_ptr_upstream", markRoutePrivatePTR, o.PrivatePTRUpstream)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init private ptr upstream, %w", err)
+		}
+		ptr.f = p
+	}
+	route = append(route, ptr)
+
+	// init upstream
+	if len(o.Upstream) > 0 {
+		p, err := b.forward(prefix+"upstream", markRouteUpstream, o.Upstream)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init upstream, %w", err)
 		}
-		route = append(route, p.(handler.Executable))
+		route = append(route, p)
 	} else {
-		if len(opt.LocalUpstream) == 0 {
+		if len(o.LocalUpstream) == 0 {
 			return nil, errors.New("missing local upstream")
 		}
-		if len(opt.RemoteUpstream) == 0 {
+		if len(o.RemoteUpstream) == 0 {
 			return nil, errors.New("missing remote upstream")
 		}
 
@@ -358,59 +837,47 @@ func initEntry() (handler.ExecutableChainNode, error) {
 		var remoteFastForward handler.Executable
 
 		// init local upstream
-		args, err := initFastForwardArgs(opt.LocalUpstream)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse local upstream, %w", err)
-		}
-		p, err := fastforward.Init(handler.NewBP("local_upstream", fastforward.PluginType), args)
+		p, err := b.forward(prefix+"local_upstream", markRouteLocal, o.LocalUpstream)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init local upstream, %w", err)
 		}
-		localFastForward = p.(handler.Executable)
+		localFastForward = p
+		localForward := p
 
 		// init remote upstream
-		args, err = initFastForwardArgs(opt.RemoteUpstream)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse remote upstream, %w", err)
-		}
-		p, err = fastforward.Init(handler.NewBP("remote_upstream", fastforward.PluginType), args)
+		p, err = b.forward(prefix+"remote_upstream", markRouteRemote, o.RemoteUpstream)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init remote upstream, %w", err)
 		}
-		remoteFastForward = p.(handler.Executable)
+		remoteFastForward = p
 
 		var localIPMatcher handler.Matcher
 		var localDomainMatcher handler.Matcher
 		var remoteDomainMatcher handler.Matcher
 
-		if len(opt.LocalIP) > 0 {
-			nl := netlist.NewList()
-			if err := netlist.BatchLoadFromFiles(nl, opt.LocalIP); err != nil {
+		if len(o.LocalIP) > 0 {
+			set, err := b.ipSet(prefix+"local_ip", o.LocalIP)
+			if err != nil {
 				return nil, fmt.Errorf("failed to load local ip file, %w", err)
 			}
-			nl.Sort()
-			mlog.S().Infof("local ip files loaded, total length: %d", nl.Len())
-			localIPMatcher = msg_matcher.NewAAAAAIPMatcher(nl)
+			localIPMatcher = &answerIPMatcher{ips: set, local: localForward}
 		}
 
-		if len(opt.LocalDomain) > 0 {
-			matcher, err := loadDomainMatcher(opt.LocalDomain)
+		if len(o.LocalDomain) > 0 {
+			set, err := b.domainSet(prefix+"local_domain", o.LocalDomain)
 			if err != nil {
 				return nil, fmt.Errorf("failed to load local domain file, %w", err)
 			}
-			mlog.S().Infof("local domain files loaded, total length: %d", matcher.Len())
-			localDomainMatcher = msg_matcher.NewQNameMatcher(matcher)
+			localDomainMatcher = msg_matcher.NewQNameMatcher(set)
 		}
 
-		if len(opt.RemoteDomain) > 0 {
-			matcher, err := loadDomainMatcher(opt.RemoteDomain)
+		if len(o.RemoteDomain) > 0 {
+			set, err := b.domainSet(prefix+"remote_domain", o.RemoteDomain)
 			if err != nil {
 				return nil, fmt.Errorf("failed to load remote domain file, %w", err)
 			}
-			mlog.S().Infof("remote domain files loaded, total length: %d", matcher.Len())
-			remoteDomainMatcher = msg_matcher.NewQNameMatcher(matcher)
+			remoteDomainMatcher = msg_matcher.NewQNameMatcher(set)
 		}
-
 		switch {
 		case localIPMatcher != nil:
 			// forward local domain to local upstream.
@@ -435,8 +902,12 @@ func initEntry() (handler.ExecutableChainNode, error) {
 				route = append(route, node)
 			}
 
-			// forward non A/AAAA query to local upstream.
-			m := executable_seq.NagateMatcher(msg_matcher.NewQTypeMatcher(elem.NewIntMatcher([]int{1, 28})))
+			// forward other query types to local upstream.
+			qtypes, err := parseQtypes(o.LocalIPQtype)
+			if err != nil {
+				return nil, fmt.Errorf("invalid local ip qtype, %w", err)
+			}
+			m := executable_seq.NagateMatcher(msg_matcher.NewQTypeMatcher(elem.NewIntMatcher(qtypes)))
 			innerNode := handler.WrapExecutable(localFastForward)
 			innerNode.LinkNext(handler.WrapExecutable(&end{}))
 			node := &executable_seq.IfNode{
@@ -453,7 +924,7 @@ func initEntry() (handler.ExecutableChainNode, error) {
 			}
 			primaryRoot.LinkNext(primaryIf)
 
-			localLatency := opt.LocalLatency
+			localLatency := o.LocalLatency
 			if localLatency <= 0 {
 				localLatency = 50
 			}
@@ -496,30 +967,19 @@ func initEntry() (handler.ExecutableChainNode, error) {
 
 	}
 
-	p, err := ttl.Init(handler.NewBP("ttl", ttl.PluginType), &ttl.Args{
-		MaximumTTL: opt.MaxTTL,
-		MinimalTTL: opt.MinTTL,
+	p, err := ttl.Init(handler.NewBP(prefix+"ttl", ttl.PluginType), &ttl.Args{
+		MaximumTTL: o.MaxTTL,
+		MinimalTTL: o.MinTTL,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to init ttl, %w", err)
 	}
+	b.plugins = append(b.plugins, p)
 	route = append(route, p.(handler.Executable))
-
-	ii := make([]interface{}, 0, len(route))
-	for _, node := range route {
-		ii = append(ii, node)
-	}
-	entry, err := executable_seq.ParseExecutableNode(ii, mlog.L())
-	if err != nil {
-		return nil, fmt.Errorf("inner err, failed to init entry, %w", err)
-	}
-
-	load_cache.GetCache().Purge()
-	debug.FreeOSMemory()
-	return entry, nil
+	return route, nil
 }
 
-func parseFastUpstream(s string) (*fastforward.UpstreamConfig, error) {
+func parseFastUpstream(o *Opt, s string) (*fastforward.UpstreamConfig, error) {
 	if !strings.Contains(s, "://") {
 		s = "udp://" + s
 	}
@@ -536,7 +996,7 @@ func parseFastUpstream(s string) (*fastforward.UpstreamConfig, error) {
 		EnableHTTP3:        v.Get("enable_http3") == "true",
 		EnablePipeline:     v.Get("enable_pipeline") == "true",
 		MaxConns:           4,
-		InsecureSkipVerify: opt.Insecure,
+		InsecureSkipVerify: o.Insecure,
 	}
 	idt := 0
 	if s := v.Get("keepalive"); len(s) != 0 {
@@ -551,10 +1011,10 @@ func parseFastUpstream(s string) (*fastforward.UpstreamConfig, error) {
 	return uc, nil
 }
 
-func initFastForwardArgs(upstreams []string) (*fastforward.Args, error) {
+func initFastForwardArgs(o *Opt, upstreams []string) (*fastforward.Args, error) {
 	ua := new(fastforward.Args)
 	for i, s := range upstreams {
-		uc, err := parseFastUpstream(s)
+		uc, err := parseFastUpstream(o, s)
 		if err != nil {
 			return nil, fmt.Errorf("invalid upstream address [%s], %w", s, err)
 		}
@@ -563,14 +1023,6 @@ func initFastForwardArgs(upstreams []string) (*fastforward.Args, error) {
 		}
 		ua.Upstream = append(ua.Upstream, uc)
 	}
-	ua.CA = opt.CA
+	ua.CA = o.CA
 	return ua, nil
 }
-
-func loadDomainMatcher(files []string) (*domain.MixMatcher[struct{}], error) {
-	mixMatcher := domain.NewMixMatcher[struct{}]()
-	if err := domain.BatchLoad[struct{}](mixMatcher, addFilePrefix(files), nil); err != nil {
-		return nil, err
-	}
-	return mixMatcher, nil
-}
@@ -0,0 +1,156 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const metricsNamespace = "mosdns_cn"
+
+var (
+	queriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queries_total",
+		Help:      "The number of queries received by listeners.",
+	}, []string{"listener", "protocol", "qtype", "rcode"})
+	cacheQueriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_queries_total",
+		Help:      "The number of cache lookups. Result is hit, miss or lazy_update.",
+	}, []string{"result"})
+	blacklistHitsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "blacklist_hits_total",
+		Help:      "The number of queries blocked by the blacklist.",
+	})
+	rejectedQueriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rejected_queries_total",
+		Help:      "The number of queries rejected by the client acl.",
+	})
+	routeTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "route_total",
+		Help:      "The number of queries answered by the local or the remote upstream.",
+	}, []string{"route"})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_duration_seconds",
+		Help:      "The response latency of upstreams.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 11), // 5ms ~ 5s
+	}, []string{"group", "upstream"})
+	upstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_errors_total",
+		Help:      "The number of failed upstream exchanges.",
+	}, []string{"group", "upstream"})
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		queriesTotal,
+		cacheQueriesTotal,
+		blacklistHitsTotal,
+		rejectedQueriesTotal,
+		routeTotal,
+		upstreamDuration,
+		upstreamErrorsTotal,
+	)
+}
+
+// startMetricsServer starts a http server that serves the metrics at
+// /metrics in a new goroutine.
+func startMetricsServer(addr string) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mlog.S().Infof("metrics server is listening on %s", l.Addr())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	s := &http.Server{Handler: mux}
+	go func() {
+		if err := s.Serve(l); err != http.ErrServerClosed {
+			mlog.S().Errorf("metrics server exited, %v", err)
+		}
+	}()
+	return s, nil
+}
+
+// metricsHandler counts queries that received by a listener.
+type metricsHandler struct {
+	next     dns_handler.Handler
+	listener string
+	protocol string
+}
+
+func (h *metricsHandler) ServeDNS(ctx context.Context, req *dns.Msg, w dns_handler.ResponseWriter, meta *handler.RequestMeta) error {
+	rw := &rcodeWriter{ResponseWriter: w, rcode: -1}
+	err := h.next.ServeDNS(ctx, req, rw, meta)
+
+	qtype := "none"
+	if len(req.Question) >= 1 {
+		qtype = qtypeLabel(req.Question[0].Qtype)
+	}
+	rcode := "dropped"
+	if rw.rcode >= 0 {
+		var ok bool
+		if rcode, ok = dns.RcodeToString[rw.rcode]; !ok {
+			rcode = strconv.Itoa(rw.rcode)
+		}
+	}
+	queriesTotal.WithLabelValues(h.listener, h.protocol, qtype, rcode).Inc()
+	return err
+}
+
+// qtypeLabel returns the name of qtype, or "other" if qtype is unknown.
+// Query types are chosen by clients, unknown types are not counted
+// separately to keep the number of label values bounded.
+func qtypeLabel(qtype uint16) string {
+	if s, ok := dns.TypeToString[qtype]; ok {
+		return s
+	}
+	return "other"
+}
+
+// rcodeWriter records the rcode of the response.
+type rcodeWriter struct {
+	dns_handler.ResponseWriter
+	rcode int // -1 if no response was written
+}
+
+func (w *rcodeWriter) Write(m *dns.Msg) error {
+	w.rcode = m.Rcode
+	return w.ResponseWriter.Write(m)
+}
@@ -0,0 +1,157 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/domain"
+	"github.com/miekg/dns"
+	"net/netip"
+	"strings"
+)
+
+// privatePrefixes are the private and special-use address ranges whose
+// reverse lookups should not be sent to the internet. See RFC 6303.
+var privatePrefixes = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"2001:db8::/32",
+}
+
+// privateReverseZones maps names to their reverse zones of privatePrefixes.
+var privateReverseZones = func() *domain.DomainMatcher[string] {
+	m := domain.NewDomainMatcher[string]()
+	for _, s := range privatePrefixes {
+		for _, zone := range reverseZones(netip.MustParsePrefix(s)) {
+			m.Add(zone, zone)
+		}
+	}
+	return m
+}()
+
+// reverseZones returns the reverse zones of p. If the prefix length of p
+// is not on a label boundary, p is split into the zones of sub prefixes.
+// e.g. "172.16.0.0/12" -> "16.172.in-addr.arpa.", ..., "31.172.in-addr.arpa."
+func reverseZones(p netip.Prefix) []string {
+	step, format, suffix := 8, "%d.", "in-addr.arpa." // bits of a label
+	if p.Addr().Is6() {
+		step, format, suffix = 4, "%x.", "ip6.arpa."
+	}
+	b := p.Masked().Addr().AsSlice()
+	label := func(i int) int {
+		switch {
+		case step == 8:
+			return int(b[i])
+		case i%2 == 0:
+			return int(b[i/2] >> 4)
+		default:
+			return int(b[i/2] & 0xf)
+		}
+	}
+
+	n := (p.Bits() + step - 1) / step // number of labels
+	zones := make([]string, 0)
+	for i := 0; i < 1<<(n*step-p.Bits()); i++ { // only the last label varies
+		sb := new(strings.Builder)
+		for j := n - 1; j >= 0; j-- {
+			v := label(j)
+			if j == n-1 {
+				v += i
+			}
+			fmt.Fprintf(sb, format, v)
+		}
+		sb.WriteString(suffix)
+		zones = append(zones, sb.String())
+	}
+	return zones
+}
+
+// privatePTR handles queries in the reverse zones of private addresses.
+// It forwards them to f, or answers them locally like an empty zone of
+// RFC 6303 if f is nil.
+type privatePTR struct {
+	f *forward
+}
+
+func (p *privatePTR) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	question := q.Question[0]
+	zone, ok := privateReverseZones.Match(question.Name)
+	if !ok {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	if p.f != nil {
+		// The chain ends here, the upstreams after it must not see
+		// the query.
+		return p.f.Exec(ctx, qCtx, nil)
+	}
+
+	soa := emptyZoneSOA(zone)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	switch {
+	case !strings.EqualFold(question.Name, zone):
+		r.Rcode = dns.RcodeNameError
+		r.Ns = append(r.Ns, soa)
+	case question.Qtype == dns.TypeSOA:
+		r.Answer = append(r.Answer, soa)
+	case question.Qtype == dns.TypeNS:
+		r.Answer = append(r.Answer, &dns.NS{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: soa.Hdr.Ttl},
+			Ns:  zone,
+		})
+	default:
+		r.Ns = append(r.Ns, soa)
+	}
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	qCtx.AddMark(markRoutePrivatePTR)
+	return nil
+}
+
+// emptyZoneSOA returns the SOA record of an empty zone. See RFC 6303.
+func emptyZoneSOA(zone string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 10800},
+		Ns:      zone,
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  10800,
+	}
+}
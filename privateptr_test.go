@@ -0,0 +1,163 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testDNSServer is a udp dns server that answers queries with h.
+type testDNSServer struct {
+	addr  string
+	calls int32
+}
+
+func newTestDNSServer(t *testing.T, h func(q *dns.Msg) *dns.Msg) *testDNSServer {
+	t.Helper()
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testDNSServer{addr: c.LocalAddr().String()}
+	ds := &dns.Server{PacketConn: c, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		atomic.AddInt32(&s.calls, 1)
+		w.WriteMsg(h(q))
+	})}
+	go ds.ActivateAndServe()
+	t.Cleanup(func() { ds.Shutdown() })
+	return s
+}
+
+func (s *testDNSServer) count() int {
+	return int(atomic.LoadInt32(&s.calls))
+}
+
+// answerRR returns a handler that answers queries with rr.
+func answerRR(rr string) func(q *dns.Msg) *dns.Msg {
+	return func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		a, err := dns.NewRR(rr)
+		if err != nil {
+			panic(err)
+		}
+		a.Header().Name = q.Question[0].Name
+		r.Answer = append(r.Answer, a)
+		return r
+	}
+}
+
+// buildTestChain builds the chain of o without the cache.
+func buildTestChain(t *testing.T, o *Opt) handler.Executable {
+	t.Helper()
+	b := newChainBuilder(o)
+	t.Cleanup(func() { (&entry{plugins: b.plugins}).shutdown(nil) })
+	route, err := b.buildChain(o, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := parseChain(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &chainExec{node}
+}
+
+// chainExec executes a chain.
+type chainExec struct {
+	node handler.ExecutableChainNode
+}
+
+func (c *chainExec) Exec(ctx context.Context, qCtx *handler.Context, _ handler.ExecutableChainNode) error {
+	return handler.ExecChainNode(ctx, qCtx, c.node)
+}
+
+func Test_privatePTR_upstream(t *testing.T) {
+	private := newTestDNSServer(t, answerRR("x. 60 IN PTR router.lan."))
+	public := newTestDNSServer(t, answerRR("x. 60 IN PTR public.example."))
+	o := &Opt{
+		Upstream:           []string{"udp://" + public.addr},
+		PrivatePTRUpstream: []string{"udp://" + private.addr},
+	}
+	chain := buildTestChain(t, o)
+
+	r := execQuery(t, chain, nil, "1.1.168.192.in-addr.arpa.", dns.TypePTR)
+	if r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.PTR).Ptr != "router.lan." {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	if private.count() != 1 || public.count() != 0 {
+		t.Fatalf("private upstream got %d queries, public upstream got %d", private.count(), public.count())
+	}
+
+	// other reverse lookups go to the public upstream
+	r = execQuery(t, chain, nil, "8.8.8.8.in-addr.arpa.", dns.TypePTR)
+	if r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.PTR).Ptr != "public.example." {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	if private.count() != 1 || public.count() != 1 {
+		t.Fatalf("private upstream got %d queries, public upstream got %d", private.count(), public.count())
+	}
+}
+
+func Test_privatePTR_local(t *testing.T) {
+	public := newTestDNSServer(t, answerRR("x. 60 IN PTR public.example."))
+	chain := buildTestChain(t, &Opt{Upstream: []string{"udp://" + public.addr}})
+
+	r := execQuery(t, chain, nil, "1.0.16.172.in-addr.arpa.", dns.TypePTR)
+	if r == nil || r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 || r.Ns[0].Header().Name != "16.172.in-addr.arpa." {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	r = execQuery(t, chain, nil, "16.172.in-addr.arpa.", dns.TypeNS)
+	if r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	if public.count() != 0 {
+		t.Fatalf("public upstream got %d queries", public.count())
+	}
+}
+
+func Test_reverseZones(t *testing.T) {
+	tests := []struct {
+		p    string
+		want []string
+	}{
+		{"10.0.0.0/8", []string{"10.in-addr.arpa."}},
+		{"100.64.0.0/10", nil},
+		{"fc00::/7", []string{"c.f.ip6.arpa.", "d.f.ip6.arpa."}},
+		{"::1/128", []string{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa."}},
+	}
+	for _, tt := range tests {
+		got := reverseZones(netip.MustParsePrefix(tt.p))
+		if tt.p == "100.64.0.0/10" {
+			if len(got) != 64 || got[0] != "64.100.in-addr.arpa." || got[63] != "127.100.in-addr.arpa." {
+				t.Errorf("reverseZones(%s) = %v", tt.p, got)
+			}
+			continue
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("reverseZones(%s) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
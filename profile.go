@@ -0,0 +1,177 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+)
+
+// Profile is a client group that uses its own hosts, blacklist and
+// upstreams. Omitted settings are inherited from the global settings.
+// Rule lists are added to the global ones, or replace them if ListMode
+// is "replace". Upstreams always replace the global ones.
+type Profile struct {
+	Name     string   `yaml:"name"`
+	Clients  []string `yaml:"clients"`             // ip lists, like the local ip
+	ListMode string   `yaml:"list_mode,omitempty"` // "append" (default) or "replace"
+
+	Hosts           []string `yaml:"hosts,omitempty"`
+	BlacklistDomain []string `yaml:"blacklist_domain,omitempty"`
+	WhitelistDomain []string `yaml:"whitelist_domain,omitempty"`
+	Upstream        []string `yaml:"upstream,omitempty"`
+	LocalUpstream   []string `yaml:"local_upstream,omitempty"`
+	LocalIP         []string `yaml:"local_ip,omitempty"`
+	LocalDomain     []string `yaml:"local_domain,omitempty"`
+	RemoteUpstream  []string `yaml:"remote_upstream,omitempty"`
+	RemoteDomain    []string `yaml:"remote_domain,omitempty"`
+	SafeSearch      *bool    `yaml:"safe_search,omitempty"`
+}
+
+// Modes of Profile.ListMode.
+const (
+	profileListAppend  = "append"
+	profileListReplace = "replace"
+)
+
+// apply returns a copy of o with the settings of p.
+func (p *Profile) apply(o *Opt) *Opt {
+	po := *o
+	inherit := func(dst *[]string, v []string) {
+		if v != nil {
+			*dst = v
+		}
+	}
+	rules := func(dst *[]string, v []string) {
+		if p.ListMode == profileListReplace {
+			inherit(dst, v)
+			return
+		}
+		*dst = appendNew(*dst, v)
+	}
+	rules(&po.Hosts, p.Hosts)
+	rules(&po.BlacklistDomain, p.BlacklistDomain)
+	rules(&po.WhitelistDomain, p.WhitelistDomain)
+	rules(&po.LocalIP, p.LocalIP)
+	rules(&po.LocalDomain, p.LocalDomain)
+	rules(&po.RemoteDomain, p.RemoteDomain)
+	inherit(&po.Upstream, p.Upstream)
+	inherit(&po.LocalUpstream, p.LocalUpstream)
+	inherit(&po.RemoteUpstream, p.RemoteUpstream)
+	if p.SafeSearch != nil {
+		po.SafeSearch = *p.SafeSearch
+	}
+	return &po
+}
+
+// appendNew returns a new slice of ss and the elements of v that are not
+// in ss.
+func appendNew(ss, v []string) []string {
+	if len(v) == 0 {
+		return ss
+	}
+	out := append([]string(nil), ss...)
+	seen := make(map[string]struct{}, len(ss)+len(v))
+	for _, s := range ss {
+		seen[s] = struct{}{}
+	}
+	for _, s := range v {
+		if _, ok := seen[s]; !ok {
+			seen[s] = struct{}{}
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// buildProfiles builds the chains of profiles in o. Queries from
+// other clients go to def.
+func (b *chainBuilder) buildProfiles(o *Opt, def []handler.Executable) (*profileSelector, error) {
+	defNode, err := parseChain(def)
+	if err != nil {
+		return nil, err
+	}
+	sel := &profileSelector{def: defNode}
+	names := make(map[string]struct{})
+	for i := range o.Profiles {
+		p := &o.Profiles[i]
+		if len(p.Name) == 0 {
+			return nil, fmt.Errorf("profile #%d has no name", i)
+		}
+		if _, dup := names[p.Name]; dup {
+			return nil, fmt.Errorf("duplicated profile %s", p.Name)
+		}
+		names[p.Name] = struct{}{}
+		if len(p.Clients) == 0 {
+			return nil, fmt.Errorf("profile %s has no clients", p.Name)
+		}
+		switch p.ListMode {
+		case "", profileListAppend, profileListReplace:
+		default:
+			return nil, fmt.Errorf("profile %s has an invalid list_mode %s", p.Name, p.ListMode)
+		}
+
+		prefix := p.Name + "/"
+		clients, err := b.ipSet(prefix+"clients", p.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load clients of profile %s, %w", p.Name, err)
+		}
+		cachePlugin, err := b.cache(p.Name)
+		if err != nil {
+			return nil, err
+		}
+		chain, err := b.buildChain(p.apply(o), prefix, cachePlugin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init profile %s, %w", p.Name, err)
+		}
+		node, err := parseChain(chain)
+		if err != nil {
+			return nil, err
+		}
+		sel.profiles = append(sel.profiles, &clientProfile{name: p.Name, clients: clients, chain: node})
+		mlog.S().Infof("profile %s loaded", p.Name)
+	}
+	return sel, nil
+}
+
+type clientProfile struct {
+	name    string
+	clients netlist.Matcher
+	chain   handler.ExecutableChainNode
+}
+
+// profileSelector executes the chain of the first profile that the
+// client belongs to. It must be the last node of the entry.
+type profileSelector struct {
+	profiles []*clientProfile
+	def      handler.ExecutableChainNode
+}
+
+func (s *profileSelector) Exec(ctx context.Context, qCtx *handler.Context, _ handler.ExecutableChainNode) error {
+	if ip := qCtx.ReqMeta().ClientIP; ip != nil {
+		for _, p := range s.profiles {
+			if ok, _ := p.clients.Match(ip); ok {
+				return handler.ExecChainNode(ctx, qCtx, p.chain)
+			}
+		}
+	}
+	return handler.ExecChainNode(ctx, qCtx, s.def)
+}
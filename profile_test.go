@@ -0,0 +1,145 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_Profile_apply(t *testing.T) {
+	o := &Opt{
+		Hosts:           []string{"hosts"},
+		BlacklistDomain: []string{"ad.txt"},
+		WhitelistDomain: []string{"white.txt"},
+		Upstream:        []string{"udp://1.1.1.1"},
+	}
+	yes := true
+	tests := []struct {
+		name  string
+		p     Profile
+		check func(po *Opt) bool
+	}{
+		{"inherit", Profile{}, func(po *Opt) bool {
+			return reflect.DeepEqual(po, o)
+		}},
+		{"append", Profile{BlacklistDomain: []string{"ad.txt", "game.txt"}, LocalDomain: []string{"lan.txt"}}, func(po *Opt) bool {
+			return reflect.DeepEqual(po.BlacklistDomain, []string{"ad.txt", "game.txt"}) &&
+				reflect.DeepEqual(po.LocalDomain, []string{"lan.txt"}) &&
+				reflect.DeepEqual(po.Hosts, o.Hosts)
+		}},
+		{"append empty", Profile{BlacklistDomain: []string{}}, func(po *Opt) bool {
+			return reflect.DeepEqual(po.BlacklistDomain, o.BlacklistDomain)
+		}},
+		{"explicit append", Profile{ListMode: profileListAppend, Hosts: []string{"kids_hosts"}}, func(po *Opt) bool {
+			return reflect.DeepEqual(po.Hosts, []string{"hosts", "kids_hosts"})
+		}},
+		{"replace", Profile{ListMode: profileListReplace, BlacklistDomain: []string{"game.txt"}, WhitelistDomain: []string{}}, func(po *Opt) bool {
+			return reflect.DeepEqual(po.BlacklistDomain, []string{"game.txt"}) &&
+				len(po.WhitelistDomain) == 0 &&
+				reflect.DeepEqual(po.Hosts, o.Hosts) // omitted lists are inherited
+		}},
+		{"upstreams replace", Profile{Upstream: []string{"udp://8.8.8.8"}}, func(po *Opt) bool {
+			return reflect.DeepEqual(po.Upstream, []string{"udp://8.8.8.8"})
+		}},
+		{"upstreams disabled", Profile{Upstream: []string{}}, func(po *Opt) bool {
+			return po.Upstream != nil && len(po.Upstream) == 0
+		}},
+		{"safe search", Profile{SafeSearch: &yes}, func(po *Opt) bool {
+			return po.SafeSearch && !o.SafeSearch
+		}},
+	}
+	for _, tt := range tests {
+		po := tt.p.apply(o)
+		if !tt.check(po) {
+			t.Errorf("%s: unexpected opt %+v", tt.name, po)
+		}
+	}
+	if !reflect.DeepEqual(o.BlacklistDomain, []string{"ad.txt"}) || !reflect.DeepEqual(o.Hosts, []string{"hosts"}) {
+		t.Fatalf("the global opt is changed: %+v", o)
+	}
+}
+
+func Test_buildProfiles(t *testing.T) {
+	upstream := newTestDNSServer(t, answerRR("x. 60 IN A 93.184.216.34"))
+	dir := t.TempDir()
+	ad := filepath.Join(dir, "ad.txt")
+	game := filepath.Join(dir, "game.txt")
+	if err := os.WriteFile(ad, []byte("domain:ad.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(game, []byte("domain:game.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	o := &Opt{
+		Upstream:        []string{"udp://" + upstream.addr},
+		BlacklistDomain: []string{ad},
+		Profiles: []Profile{
+			{Name: "kids", Clients: []string{"192.168.1.100"}, BlacklistDomain: []string{game}},
+			{Name: "servers", Clients: []string{"192.168.1.10"}, ListMode: profileListReplace, BlacklistDomain: []string{}},
+		},
+	}
+	b := newChainBuilder(o)
+	t.Cleanup(func() { (&entry{plugins: b.plugins}).shutdown(nil) })
+	def, err := b.buildChain(o, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel, err := b.buildProfiles(o, def)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := func(client, name string) bool {
+		t.Helper()
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := handler.NewContext(q, &handler.RequestMeta{ClientIP: net.ParseIP(client)})
+		if err := sel.Exec(context.Background(), qCtx, nil); err != nil {
+			t.Fatal(err)
+		}
+		r := qCtx.R()
+		return r == nil || len(r.Answer) == 0
+	}
+	for _, tt := range []struct {
+		client, name string
+		blocked      bool
+	}{
+		{"192.168.1.2", "ad.example.", true},
+		{"192.168.1.2", "game.example.", false},
+		{"192.168.1.100", "ad.example.", true}, // the global list is kept
+		{"192.168.1.100", "game.example.", true},
+		{"192.168.1.10", "ad.example.", false},
+		{"192.168.1.10", "game.example.", false},
+	} {
+		if got := blocked(tt.client, tt.name); got != tt.blocked {
+			t.Errorf("%s %s: blocked %v, want %v", tt.client, tt.name, got, tt.blocked)
+		}
+	}
+
+	o.Profiles = []Profile{{Name: "x", Clients: []string{"192.168.1.1"}, ListMode: "merge"}}
+	if _, err := b.buildProfiles(o, def); err == nil {
+		t.Fatal("want an error for an invalid list_mode")
+	}
+}
@@ -0,0 +1,107 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// forwardedHandler sets the remote address of requests from reverse
+// proxies to the client address in their X-Forwarded-For headers.
+//
+// Clients can send any X-Forwarded-For header, only the hops appended by
+// the proxies can be trusted. If trusted is empty, the peer is trusted to
+// be the proxy and the rightmost hop is the client. Otherwise the header
+// is only read from trusted peers, and the client is the rightmost hop
+// that is not a trusted proxy.
+type forwardedHandler struct {
+	next    http.Handler
+	trusted []netip.Prefix
+}
+
+func (h *forwardedHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if ip, ok := h.clientAddr(req); ok {
+		req.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+	}
+	h.next.ServeHTTP(w, req)
+}
+
+// clientAddr returns the client address in the X-Forwarded-For headers
+// of req. It returns false if the remote address of req is the client.
+func (h *forwardedHandler) clientAddr(req *http.Request) (netip.Addr, bool) {
+	peer, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil || !h.isTrusted(peer.Addr()) {
+		return netip.Addr{}, false
+	}
+	var hops []string
+	for _, v := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break // hops on the left of an invalid hop are not trusted
+		}
+		client = ip.Unmap()
+		if len(h.trusted) == 0 || !h.isTrusted(client) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+// isTrusted reports whether addr is a trusted proxy.
+func (h *forwardedHandler) isTrusted(addr netip.Addr) bool {
+	if len(h.trusted) == 0 {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, p := range h.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses ips and CIDRs in ss.
+func parseTrustedProxies(ss []string) ([]netip.Prefix, error) {
+	ps := make([]netip.Prefix, 0, len(ss))
+	for _, s := range ss {
+		var p netip.Prefix
+		var err error
+		if strings.Contains(s, "/") {
+			p, err = netip.ParsePrefix(s)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(s)
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s, %w", s, err)
+		}
+		ps = append(ps, p.Masked())
+	}
+	return ps, nil
+}
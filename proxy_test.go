@@ -0,0 +1,79 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_forwardedHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		peer    string
+		xff     []string
+		want    string
+	}{
+		{"no header", nil, "10.0.0.1:1234", nil, "10.0.0.1:1234"},
+		{"single hop", nil, "127.0.0.1:1234", []string{"192.168.1.2"}, "192.168.1.2:0"},
+		{"spoofed", nil, "127.0.0.1:1234", []string{"1.1.1.1, 192.168.1.2"}, "192.168.1.2:0"},
+		{"multiple headers", nil, "127.0.0.1:1234", []string{"1.1.1.1", "192.168.1.2"}, "192.168.1.2:0"},
+		{"invalid rightmost hop", nil, "127.0.0.1:1234", []string{"192.168.1.2, unknown"}, "127.0.0.1:1234"},
+		{"untrusted peer", []string{"127.0.0.1"}, "10.0.0.1:1234", []string{"192.168.1.2"}, "10.0.0.1:1234"},
+		{"trusted peer", []string{"127.0.0.1"}, "127.0.0.1:1234", []string{"1.1.1.1, 192.168.1.2"}, "192.168.1.2:0"},
+		{"trusted chain", []string{"127.0.0.1", "10.0.0.0/8"}, "127.0.0.1:1234", []string{"1.1.1.1, 192.168.1.2, 10.0.0.2"}, "192.168.1.2:0"},
+		{"all trusted", []string{"127.0.0.1", "10.0.0.0/8"}, "127.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3:0"},
+		{"invalid hop in chain", []string{"127.0.0.1", "10.0.0.0/8"}, "127.0.0.1:1234", []string{"1.1.1.1, bad, 10.0.0.2"}, "10.0.0.2:0"},
+		{"ipv6", []string{"::1"}, "[::1]:1234", []string{"2001:db8::1"}, "[2001:db8::1]:0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := parseTrustedProxies(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			h := &forwardedHandler{
+				next:    http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) { got = req.RemoteAddr }),
+				trusted: trusted,
+			}
+			req := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+			req.RemoteAddr = tt.peer
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("remote addr = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseTrustedProxies(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"127.0.0.1", "10.0.0.1/8", "::1"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"localhost", "10.0.0.0/33", ""} {
+		if _, err := parseTrustedProxies([]string{s}); err == nil {
+			t.Errorf("invalid trusted proxy %q is parsed", s)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/dnsutils"
+	"github.com/miekg/dns"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// queryLogBufSize is the number of records that can be waiting to be
+// written. Records will be dropped if the sinks are too slow.
+const queryLogBufSize = 4096
+
+// queryInfo holds the information of a query that can't be stored in
+// handler.Context. It is shared by all nodes of the query through the context.
+type queryInfo struct {
+	m         sync.Mutex
+	upstreams map[uint]string // route mark -> the upstream that answered
+}
+
+type queryInfoKey struct{}
+
+func withQueryInfo(ctx context.Context) (context.Context, *queryInfo) {
+	info := new(queryInfo)
+	return context.WithValue(ctx, queryInfoKey{}, info), info
+}
+
+// getQueryInfo returns the queryInfo of ctx. It returns nil if ctx
+// doesn't have one. e.g. ctx of a lazy cache update.
+func getQueryInfo(ctx context.Context) *queryInfo {
+	info, _ := ctx.Value(queryInfoKey{}).(*queryInfo)
+	return info
+}
+
+func (i *queryInfo) setUpstream(mark uint, addr string) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	if i.upstreams == nil {
+		i.upstreams = make(map[uint]string)
+	}
+	i.upstreams[mark] = addr
+}
+
+func (i *queryInfo) upstream(mark uint) string {
+	i.m.Lock()
+	defer i.m.Unlock()
+	return i.upstreams[mark]
+}
+
+var routes = []struct {
+	mark uint
+	name string
+}{
+	{markRouteRejected, "rejected"},
+	{markRouteZone, "zone"},
+	{markRouteHosts, "hosts"},
+	{markRouteRecords, "records"},
+	{markRouteBlacklist, "blacklist"},
+	{markRouteSafeSearch, "safe_search"},
+	{markRouteCache, "cache"},
+	{markRouteGroup, "group"},
+	{markRoutePrivatePTR, "private_ptr"},
+	{markRouteUpstream, "upstream"},
+	{markRouteLocal, "local"},
+	{markRouteRemote, "remote"},
+}
+
+// routeOf returns the route mark and its name of qCtx.
+func routeOf(qCtx *handler.Context) (uint, string) {
+	for _, r := range routes {
+		if qCtx.HasMark(r.mark) {
+			return r.mark, r.name
+		}
+	}
+	return 0, ""
+}
+
+// queryRecord is a query log record.
+type queryRecord struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	QName    string    `json:"qname"`
+	QType    string    `json:"qtype"`
+	Answers  []string  `json:"answers,omitempty"` // ip addresses in the answer section
+	RCode    string    `json:"rcode"`             // "dropped" if no response was sent
+	Route    string    `json:"route,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Latency  float64   `json:"latency_ms"`
+}
+
+// queryEntry executes the entry, then counts the route of the query
+// and writes the query log.
+type queryEntry struct {
+	next handler.Executable
+}
+
+func (e *queryEntry) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	ctx, info := withQueryInfo(ctx)
+	err := e.next.Exec(ctx, qCtx, next)
+
+	mark, routeName := routeOf(qCtx)
+	if qCtx.R() != nil && (mark == markRouteLocal || mark == markRouteRemote) {
+		routeTotal.WithLabelValues(routeName).Inc()
+	}
+	if queryLog != nil {
+		queryLog.log(newQueryRecord(qCtx, err, routeName, info.upstream(mark)))
+	}
+	return err
+}
+
+func newQueryRecord(qCtx *handler.Context, err error, route, upstream string) *queryRecord {
+	rec := &queryRecord{
+		Time:     qCtx.StartTime(),
+		Route:    route,
+		Upstream: upstream,
+		Latency:  float64(time.Since(qCtx.StartTime()).Microseconds()) / 1000,
+	}
+	if ip := qCtx.ReqMeta().ClientIP; ip != nil {
+		rec.Client = ip.String()
+	}
+	if q := qCtx.Q(); len(q.Question) >= 1 {
+		rec.QName = q.Question[0].Name
+		rec.QType = dnsutils.QtypeToString(q.Question[0].Qtype)
+	}
+
+	r := qCtx.R()
+	switch {
+	case err != nil || qCtx.Status() == handler.ContextStatusServerFailed:
+		rec.RCode = dns.RcodeToString[dns.RcodeServerFailure]
+	case r == nil:
+		rec.RCode = "dropped"
+	default:
+		var ok bool
+		if rec.RCode, ok = dns.RcodeToString[r.Rcode]; !ok {
+			rec.RCode = strconv.Itoa(r.Rcode)
+		}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				rec.Answers = append(rec.Answers, rr.A.String())
+			case *dns.AAAA:
+				rec.Answers = append(rec.Answers, rr.AAAA.String())
+			}
+		}
+	}
+	return rec
+}
+
+// queryLogSink receives query records.
+type queryLogSink interface {
+	Write(rec *queryRecord) error
+	Close() error
+}
+
+// jsonSink writes records to w in JSON lines.
+type jsonSink struct {
+	w io.Writer
+	e *json.Encoder
+}
+
+func newJSONSink(w io.Writer) *jsonSink {
+	return &jsonSink{w: w, e: json.NewEncoder(w)}
+}
+
+func (s *jsonSink) Write(rec *queryRecord) error {
+	return s.e.Encode(rec)
+}
+
+func (s *jsonSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok && s.w != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// queryLogger writes records to its sinks in a goroutine.
+type queryLogger struct {
+	sinks []queryLogSink
+
+	m       sync.RWMutex
+	closed  bool
+	c       chan *queryRecord
+	done    chan struct{}
+	dropped uint64 // atomic
+}
+
+// queryLog is the query logger. It is nil if query log is disabled.
+var queryLog *queryLogger
+
+func newQueryLogger(sinks []queryLogSink) *queryLogger {
+	l := &queryLogger{
+		sinks: sinks,
+		c:     make(chan *queryRecord, queryLogBufSize),
+		done:  make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// initQueryLog creates the query logger from o and extra sinks.
+// It returns nil if no sink is configured.
+func initQueryLog(o *Opt, extra ...queryLogSink) (*queryLogger, error) {
+	sinks := extra
+	for _, s := range o.QueryLog {
+		if s == "stdout" {
+			sinks = append(sinks, newJSONSink(os.Stdout))
+			continue
+		}
+		sinks = append(sinks, newJSONSink(&lumberjack.Logger{
+			Filename:   s,
+			MaxSize:    o.QueryLogMaxSize,
+			MaxBackups: o.QueryLogMaxBackup,
+		}))
+	}
+	if len(o.HistoryDB) > 0 {
+		s, err := newHistorySink(o.HistoryDB, time.Duration(o.HistoryRetention)*time.Hour*24)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open history database, %w", err)
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return newQueryLogger(sinks), nil
+}
+
+// history returns the history sink of l. It returns nil if l is nil or
+// the history is disabled.
+func (l *queryLogger) history() *historySink {
+	if l == nil {
+		return nil
+	}
+	for _, s := range l.sinks {
+		if h, ok := s.(*historySink); ok {
+			return h
+		}
+	}
+	return nil
+}
+
+func (l *queryLogger) log(rec *queryRecord) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.c <- rec:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+func (l *queryLogger) run() {
+	defer close(l.done)
+	for rec := range l.c {
+		for _, s := range l.sinks {
+			if err := s.Write(rec); err != nil {
+				mlog.S().Warnf("failed to write query log, %v", err)
+			}
+		}
+	}
+}
+
+// Close writes the remaining records and closes all sinks.
+func (l *queryLogger) Close() error {
+	l.m.Lock()
+	l.closed = true
+	close(l.c)
+	l.m.Unlock()
+	<-l.done
+
+	if n := atomic.LoadUint64(&l.dropped); n > 0 {
+		mlog.S().Warnf("%d query log records were dropped because the sinks were too slow", n)
+	}
+	for _, s := range l.sinks {
+		s.Close()
+	}
+	return nil
+}
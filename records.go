@@ -0,0 +1,222 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// maxCNAMEChain is the max number of CNAMEs to follow for a query.
+const maxCNAMEChain = 8
+
+// recordsSet is an executable that answers queries with local records
+// loaded from zone-file-like files. It can be reloaded at runtime.
+type recordsSet struct {
+	tag    string
+	files  []string
+	remote *remoteCache
+	t      atomic.Value // recordsTable
+	rules  map[string]struct{}
+}
+
+// recordsTable maps a lower case fqdn to its records by type.
+type recordsTable map[string]map[uint16][]dns.RR
+
+var (
+	_ ruleSet            = (*recordsSet)(nil)
+	_ handler.Executable = (*recordsSet)(nil)
+)
+
+// newRecordsSet loads a recordsSet from files. Files are in the RFC 1035
+// zone file format. e.g.
+//
+//	$TTL 300
+//	_sip._tcp.corp.example. IN SRV 10 5 5060 sip.corp.example.
+//	www.corp.example. IN CNAME www.example.com.
+func newRecordsSet(tag string, files []string, remote *remoteCache) (*recordsSet, error) {
+	s := &recordsSet{tag: tag, files: files, remote: remote}
+	if _, _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *recordsSet) Tag() string {
+	return s.tag
+}
+
+func (s *recordsSet) Files() []string {
+	return s.files
+}
+
+func (s *recordsSet) Len() int {
+	return len(s.rules)
+}
+
+func (s *recordsSet) load() (added, removed int, err error) {
+	var t recordsTable
+	var rules map[string]struct{}
+	err = s.remote.withBackup(func(localFile localFileFunc) (err error) {
+		t, rules, err = s.parse(localFile)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	added, removed = diffRules(s.rules, rules)
+	s.t.Store(t)
+	s.rules = rules
+	return added, removed, nil
+}
+
+func (s *recordsSet) check(localFile localFileFunc) error {
+	_, _, err := s.parse(localFile)
+	return err
+}
+
+func (s *recordsSet) parse(localFile localFileFunc) (recordsTable, map[string]struct{}, error) {
+	t := make(recordsTable)
+	rules := make(map[string]struct{})
+	for _, f := range s.files {
+		lf, err := localFile(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := loadRecordsFile(t, lf, rules); err != nil {
+			return nil, nil, fmt.Errorf("failed to load records file %s, %w", f, err)
+		}
+	}
+	return t, rules, nil
+}
+
+func loadRecordsFile(t recordsTable, file string, rules map[string]struct{}) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zp := dns.NewZoneParser(f, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		types := t[name]
+		if types == nil {
+			types = make(map[uint16][]dns.RR)
+			t[name] = types
+		}
+		types[hdr.Rrtype] = append(types[hdr.Rrtype], rr)
+		rules[rr.String()] = struct{}{}
+	}
+	if err := zp.Err(); err != nil {
+		return err
+	}
+	for name, types := range t {
+		if len(types[dns.TypeCNAME]) > 0 && len(types) > 1 {
+			return fmt.Errorf("%s has a CNAME record and other records", name)
+		}
+	}
+	return nil
+}
+
+func (t recordsTable) lookup(name string, qtype uint16) []dns.RR {
+	return t[strings.ToLower(name)][qtype]
+}
+
+// Exec answers the query if the name has records of the query type
+// or a CNAME record. CNAME targets that are not in the records will be
+// resolved by the rest of the chain.
+func (s *recordsSet) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	t := s.t.Load().(recordsTable)
+	question := q.Question[0]
+
+	var answer []dns.RR
+	name := question.Name
+	for i := 0; ; i++ {
+		if rrs := t.lookup(name, question.Qtype); len(rrs) > 0 {
+			answer = appendRRs(answer, rrs, name)
+			break
+		}
+		cname := t.lookup(name, dns.TypeCNAME)
+		if len(cname) == 0 {
+			break
+		}
+		if i >= maxCNAMEChain {
+			return fmt.Errorf("too many CNAMEs for %s", question.Name)
+		}
+		answer = appendRRs(answer, cname, name)
+		name = cname[0].(*dns.CNAME).Target
+	}
+	if len(answer) == 0 { // not in the records
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	r.Answer = answer
+	if last := answer[len(answer)-1]; last.Header().Rrtype == dns.TypeCNAME && question.Qtype != dns.TypeCNAME {
+		if err := resolveCNAMETarget(ctx, qCtx, next, r, last.(*dns.CNAME).Target); err != nil {
+			return err
+		}
+	}
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	qCtx.AddMark(markRouteRecords)
+	return nil
+}
+
+// resolveCNAMETarget resolves the CNAME target of the query of qCtx by
+// next, then appends the answer and copies the rcode and the authority
+// section to r.
+func resolveCNAMETarget(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode, r *dns.Msg, target string) error {
+	subQ := qCtx.Q().Copy()
+	subQ.Question[0].Name = target
+	subCtx := handler.NewContext(subQ, qCtx.ReqMeta())
+	if err := handler.ExecChainNode(ctx, subCtx, next); err != nil {
+		return err
+	}
+	subR := subCtx.R()
+	if subR == nil {
+		r.Rcode = dns.RcodeServerFailure
+		return nil
+	}
+	r.Rcode = subR.Rcode
+	r.Answer = append(r.Answer, subR.Answer...)
+	r.Ns = subR.Ns
+	return nil
+}
+
+// appendRRs appends copies of rrs to dst with the owner name, so the
+// case of the name is the same as the query.
+func appendRRs(dst, rrs []dns.RR, name string) []dns.RR {
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		dst = append(dst, rr)
+	}
+	return dst
+}
@@ -0,0 +1,182 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testRecords = `$TTL 300
+$ORIGIN corp.example.
+_sip._tcp       IN SRV   10 5 5060 sip
+sip             IN A     10.0.0.5
+mail            IN MX    10 mx.corp.example.
+info            IN TXT   "hello" "world"
+www             IN CNAME www.example.com.
+intranet        IN CNAME portal
+portal          IN CNAME sip
+gone            IN CNAME none.example.com.
+`
+
+func newTestRecordsSet(t *testing.T, body string) (*recordsSet, error) {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "records.txt")
+	if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return newRecordsSet("records", []string{p}, nil)
+}
+
+func Test_recordsSet_load(t *testing.T) {
+	s, err := newTestRecordsSet(t, testRecords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 8 {
+		t.Fatalf("Len() = %d, want 8", s.Len())
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  string // the first answer
+	}{
+		{"_sip._tcp.corp.example.", dns.TypeSRV, "_sip._tcp.corp.example.\t300\tIN\tSRV\t10 5 5060 sip.corp.example."},
+		{"SIP.corp.example.", dns.TypeA, "SIP.corp.example.\t300\tIN\tA\t10.0.0.5"},
+		{"mail.corp.example.", dns.TypeMX, "mail.corp.example.\t300\tIN\tMX\t10 mx.corp.example."},
+		{"info.corp.example.", dns.TypeTXT, "info.corp.example.\t300\tIN\tTXT\t\"hello\" \"world\""},
+		{"www.corp.example.", dns.TypeCNAME, "www.corp.example.\t300\tIN\tCNAME\twww.example.com."},
+	}
+	for _, tt := range tests {
+		r := execQuery(t, s, noReply, tt.name, tt.qtype)
+		if r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+			t.Errorf("%s %s: unexpected reply %v", tt.name, dns.TypeToString[tt.qtype], r)
+			continue
+		}
+		if got := r.Answer[0].String(); got != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+
+	// other names and types go to the rest of the chain.
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"none.corp.example.", dns.TypeA},
+		{"sip.corp.example.", dns.TypeAAAA},
+	} {
+		if r := execQuery(t, s, noReply, q.name, q.qtype); r != nil {
+			t.Errorf("%s %s: unexpected reply %v", q.name, dns.TypeToString[q.qtype], r)
+		}
+	}
+}
+
+func Test_recordsSet_invalid(t *testing.T) {
+	for name, body := range map[string]string{
+		"cname and other records": "a.example. 300 IN CNAME b.example.\na.example. 300 IN A 1.2.3.4\n",
+		"syntax error":            "a.example. 300 IN A not-an-ip\n",
+	} {
+		if _, err := newTestRecordsSet(t, body); err == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+}
+
+// targetUpstream replies the A query of target, and NXDOMAIN for others.
+type targetUpstream struct {
+	target    string
+	questions []string
+}
+
+func (u *targetUpstream) Exec(_ context.Context, qCtx *handler.Context, _ handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	u.questions = append(u.questions, q.Question[0].Name)
+	if q.Question[0].Name != u.target {
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeNameError)
+		soa, _ := dns.NewRR("example.com. 60 IN SOA ns.example.com. host.example.com. 1 3600 600 86400 60")
+		r.Ns = []dns.RR{soa}
+		qCtx.SetResponse(r, handler.ContextStatusResponded)
+		return nil
+	}
+	qCtx.SetResponse(answerA(q, 60), handler.ContextStatusResponded)
+	return nil
+}
+
+func Test_recordsSet_resolveCNAMETarget(t *testing.T) {
+	s, err := newTestRecordsSet(t, testRecords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the target is resolved by the rest of the chain.
+	u := &targetUpstream{target: "www.example.com."}
+	r := execQuery(t, s, u, "www.corp.example.", dns.TypeA)
+	if r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 2 {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	if len(u.questions) != 1 || u.questions[0] != "www.example.com." {
+		t.Fatalf("unexpected upstream questions %v", u.questions)
+	}
+	if cname, ok := r.Answer[0].(*dns.CNAME); !ok || cname.Hdr.Name != "www.corp.example." {
+		t.Fatalf("unexpected answer %v", r.Answer[0])
+	}
+	if a, ok := r.Answer[1].(*dns.A); !ok || a.Hdr.Name != "www.example.com." {
+		t.Fatalf("unexpected answer %v", r.Answer[1])
+	}
+
+	// chains in the records are followed without the upstream.
+	u = &targetUpstream{}
+	r = execQuery(t, s, u, "intranet.corp.example.", dns.TypeA)
+	if r == nil || len(r.Answer) != 3 || len(u.questions) != 0 {
+		t.Fatalf("unexpected reply %v, upstream questions %v", r, u.questions)
+	}
+	if a, ok := r.Answer[2].(*dns.A); !ok || a.Hdr.Name != "sip.corp.example." {
+		t.Fatalf("unexpected answer %v", r.Answer[2])
+	}
+
+	// the rcode and the authority section of the target are copied.
+	r = execQuery(t, s, u, "gone.corp.example.", dns.TypeA)
+	if r == nil || r.Rcode != dns.RcodeNameError || len(r.Answer) != 1 || len(r.Ns) != 1 {
+		t.Fatalf("unexpected reply %v", r)
+	}
+
+	// no reply for the target
+	r = execQuery(t, s, noReply, "www.corp.example.", dns.TypeA)
+	if r == nil || r.Rcode != dns.RcodeServerFailure || len(r.Answer) != 1 {
+		t.Fatalf("unexpected reply %v", r)
+	}
+}
+
+func Test_recordsSet_cnameLoop(t *testing.T) {
+	s, err := newTestRecordsSet(t, "a.example. 300 IN CNAME b.example.\nb.example. 300 IN CNAME a.example.\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("a.example.", dns.TypeA)
+	if err := s.Exec(context.Background(), handler.NewContext(q, nil), handler.WrapExecutable(noReply)); err == nil {
+		t.Fatal("want an error")
+	}
+}
@@ -0,0 +1,224 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/jessevdk/go-flags"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// reloadableEntry is an executable that forwards queries to the current
+// entry. The entry can be replaced at runtime.
+type reloadableEntry struct {
+	m sync.Mutex   // serializes reloads
+	v atomic.Value // *entry
+}
+
+func newReloadableEntry(e *entry) *reloadableEntry {
+	r := new(reloadableEntry)
+	r.v.Store(e)
+	return r
+}
+
+func (r *reloadableEntry) Exec(ctx context.Context, qCtx *handler.Context, _ handler.ExecutableChainNode) error {
+	e := r.acquire()
+	defer e.release()
+	return handler.ExecChainNode(context.WithValue(ctx, entryCtxKey{}, e), qCtx, e)
+}
+
+func (r *reloadableEntry) current() *entry {
+	return r.v.Load().(*entry)
+}
+
+// acquire returns the current entry. The entry will not be shut down
+// until it is released.
+func (r *reloadableEntry) acquire() *entry {
+	for {
+		// The entry may be replaced and retired after it is loaded,
+		// then the new one is loaded.
+		if e := r.current(); e.acquire() {
+			return e
+		}
+	}
+}
+
+type entryCtxKey struct{}
+
+// entryOf returns the entry that is executing ctx, or nil.
+func entryOf(ctx context.Context) *entry {
+	e, _ := ctx.Value(entryCtxKey{}).(*entry)
+	return e
+}
+
+// acquire increases the in-flight counter of e. It returns false if e
+// is retired.
+func (e *entry) acquire() bool {
+	e.refMu.Lock()
+	defer e.refMu.Unlock()
+	if e.retired {
+		return false
+	}
+	e.inflight++
+	return true
+}
+
+// tryHold increases the in-flight counter of e even if e is retired,
+// for the background work of queries, e.g. lazy cache updates. It returns
+// false if e is drained and may have been shut down.
+func (e *entry) tryHold() bool {
+	e.refMu.Lock()
+	defer e.refMu.Unlock()
+	if e.retired && e.inflight == 0 {
+		return false
+	}
+	e.inflight++
+	return true
+}
+
+func (e *entry) release() {
+	e.refMu.Lock()
+	defer e.refMu.Unlock()
+	e.inflight--
+	if e.retired && e.inflight == 0 {
+		close(e.drained)
+	}
+}
+
+// retire stops e from being acquired. The returned channel is closed
+// once all in-flight queries of e are finished.
+func (e *entry) retire() <-chan struct{} {
+	e.refMu.Lock()
+	defer e.refMu.Unlock()
+	e.retired = true
+	e.drained = make(chan struct{})
+	if e.inflight == 0 {
+		close(e.drained)
+	}
+	return e.drained
+}
+
+// reload builds a new entry from o and replaces the current entry with it.
+// If it fails, the current entry will be kept.
+func (r *reloadableEntry) reload(o *Opt) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	old := r.current()
+	e, err := initEntry(o, old)
+	if err != nil {
+		return err
+	}
+	r.replace(e)
+	return nil
+}
+
+// replace replaces the current entry with e. The old entry is shut down
+// once its in-flight queries are finished.
+func (r *reloadableEntry) replace(e *entry) {
+	old := r.current()
+	r.v.Store(e)
+	old.stopUpdates()
+	drained := old.retire()
+	go func() {
+		<-drained
+		old.shutdown(e)
+	}()
+}
+
+// shutdown shuts down the current entry.
+func (r *reloadableEntry) shutdown() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.current().shutdown(nil)
+}
+
+// loadConfigFile loads settings from the yaml file to o.
+func loadConfigFile(o *Opt, file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration file: %w", err)
+	}
+	if err := yaml.Unmarshal(b, o); err != nil {
+		return fmt.Errorf("failed to parse configuration file: %w", err)
+	}
+	return nil
+}
+
+// reloadOpt parses the cmd line arguments and reloads the configuration
+// file to a new Opt. Settings of servers, log file and working dir
+// are not reloadable, they are copied from opt.
+func reloadOpt() (*Opt, error) {
+	o := new(Opt)
+	if _, err := flags.NewParser(o, flags.PassDoubleDash).Parse(); err != nil {
+		return nil, err
+	}
+	if cf := opt.ConfigFile; len(cf) > 0 {
+		if err := loadConfigFile(o, cf); err != nil {
+			return nil, err
+		}
+	}
+
+	o.ConfigFile = opt.ConfigFile
+	o.ServerAddr = opt.ServerAddr
+	o.TLSServerAddr = opt.TLSServerAddr
+	o.DoHServerAddr = opt.DoHServerAddr
+	o.DoHPath = opt.DoHPath
+	o.DoHPlainHTTP = opt.DoHPlainHTTP
+	o.TrustedProxy = opt.TrustedProxy
+	o.DoQServerAddr = opt.DoQServerAddr
+	o.Cert = opt.Cert
+	o.Key = opt.Key
+	o.LogFile = opt.LogFile
+	o.ShutdownTimeout = opt.ShutdownTimeout
+	o.MetricsAddr = opt.MetricsAddr
+	o.AdminAddr = opt.AdminAddr
+	o.AdminToken = opt.AdminToken
+	o.Dashboard = opt.Dashboard
+	o.QueryLog = opt.QueryLog
+	o.QueryLogMaxSize = opt.QueryLogMaxSize
+	o.QueryLogMaxBackup = opt.QueryLogMaxBackup
+	o.HistoryDB = opt.HistoryDB
+	o.HistoryRetention = opt.HistoryRetention
+	o.WorkingDir = opt.WorkingDir
+	o.CD2Exe = opt.CD2Exe
+	return o, nil
+}
+
+// reloadConfig reloads the configuration and rebuilds the entry of r.
+func reloadConfig(r *reloadableEntry) error {
+	mlog.S().Info("reloading configuration")
+	o, err := reloadOpt()
+	if err == nil {
+		err = r.reload(o)
+	}
+	if err != nil {
+		mlog.L().Error("failed to reload, keep using the old configuration", zap.Error(err))
+		return err
+	}
+	setLogLevel(o)
+	mlog.S().Info("configuration reloaded")
+	return nil
+}
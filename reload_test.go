@@ -0,0 +1,114 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingExec blocks queries until release is closed.
+type blockingExec struct {
+	started chan context.Context
+	release chan struct{}
+}
+
+func (b *blockingExec) Exec(ctx context.Context, qCtx *handler.Context, _ handler.ExecutableChainNode) error {
+	b.started <- ctx
+	<-b.release
+	return nil
+}
+
+// shutdownPlugin records whether it is shut down.
+type shutdownPlugin struct {
+	down int32
+}
+
+func (p *shutdownPlugin) Tag() string  { return "test" }
+func (p *shutdownPlugin) Type() string { return "test" }
+
+func (p *shutdownPlugin) Shutdown() error {
+	atomic.StoreInt32(&p.down, 1)
+	return nil
+}
+
+func (p *shutdownPlugin) isDown() bool {
+	return atomic.LoadInt32(&p.down) == 1
+}
+
+func newTestEntry(e handler.Executable) (*entry, *shutdownPlugin) {
+	p := new(shutdownPlugin)
+	return &entry{ExecutableChainNode: handler.WrapExecutable(e), plugins: []handler.Plugin{p}}, p
+}
+
+func waitShutdown(t *testing.T, p *shutdownPlugin, want bool) {
+	t.Helper()
+	time.Sleep(time.Millisecond * 50)
+	if p.isDown() != want {
+		t.Fatalf("shut down = %v, want %v", p.isDown(), want)
+	}
+}
+
+func Test_reloadableEntry_replace(t *testing.T) {
+	b := &blockingExec{started: make(chan context.Context, 1), release: make(chan struct{})}
+	old, oldP := newTestEntry(b)
+	r := newReloadableEntry(old)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	done := make(chan struct{})
+	go func() {
+		r.Exec(context.Background(), handler.NewContext(q, nil), nil)
+		close(done)
+	}()
+	ctx := <-b.started
+
+	e, newP := newTestEntry(&blockingExec{started: make(chan context.Context, 1), release: make(chan struct{})})
+	r.replace(e)
+	if r.acquire() != e {
+		t.Fatal("new queries are not executed by the new entry")
+	}
+	e.release()
+
+	// the old entry is kept until its queries are finished
+	waitShutdown(t, oldP, false)
+	held := entryOf(ctx)
+	if held != old || !held.tryHold() {
+		t.Fatal("failed to hold the old entry")
+	}
+	close(b.release)
+	<-done
+	waitShutdown(t, oldP, false)
+	held.release()
+	waitShutdown(t, oldP, true)
+	if old.tryHold() {
+		t.Fatal("a drained entry is held")
+	}
+	if newP.isDown() {
+		t.Fatal("the new entry is shut down")
+	}
+
+	// an idle entry is shut down immediately
+	e2, _ := newTestEntry(b)
+	r.replace(e2)
+	waitShutdown(t, newP, true)
+}
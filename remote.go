@@ -0,0 +1,359 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const remoteFileTimeout = time.Minute
+
+// isRemoteFile reports whether the rule file arg s is an http(s) url.
+func isRemoteFile(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// remoteCache downloads remote rule files to a local dir.
+type remoteCache struct {
+	dir    string
+	client *http.Client
+}
+
+func newRemoteCache(dir string) *remoteCache {
+	return &remoteCache{
+		dir:    dir,
+		client: &http.Client{Timeout: remoteFileTimeout},
+	}
+}
+
+// remoteFileMeta is saved with the cached file, it is used to send
+// conditional requests.
+type remoteFileMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// path returns the local path of the cached file of u.
+func (c *remoteCache) path(u string) string {
+	h := sha256.Sum256([]byte(u))
+	name := hex.EncodeToString(h[:8])
+	if pu, err := url.Parse(u); err == nil {
+		if base := path.Base(pu.Path); base != "/" && base != "." {
+			name = name + "_" + base
+		}
+	}
+	return filepath.Join(c.dir, name)
+}
+
+// localFileFunc returns the local path to read the rule file file from.
+type localFileFunc func(file string) (string, error)
+
+// get returns the local path of u. If u has not been cached, it
+// will be downloaded. downloaded reports whether it was.
+func (c *remoteCache) get(u string) (p string, downloaded bool, err error) {
+	p = c.path(u)
+	if _, err := os.Stat(p); err == nil {
+		return p, false, nil
+	}
+	// nothing to check the download against, the rule set that loads it
+	// checks it, see withBackup.
+	if _, err := c.fetch(context.Background(), u, nil); err != nil {
+		return "", false, fmt.Errorf("failed to download %s, %w", u, err)
+	}
+	return p, true, nil
+}
+
+// localFile returns the local path of file. Remote files are
+// downloaded to the cache dir.
+func (c *remoteCache) localFile(file string) (string, error) {
+	if !isRemoteFile(file) {
+		return file, nil
+	}
+	p, _, err := c.get(file)
+	return p, err
+}
+
+// withBackup calls parse with the cached copies of remote files. If it
+// fails, the files that were just downloaded are removed, so they will
+// be downloaded again next time, and parse is retried with the backups
+// of the last good copies, if there are any.
+func (c *remoteCache) withBackup(parse func(localFile localFileFunc) error) error {
+	if c == nil {
+		return parse(c.localFile)
+	}
+	var downloaded []string
+	err := parse(func(file string) (string, error) {
+		if !isRemoteFile(file) {
+			return file, nil
+		}
+		p, ok, err := c.get(file)
+		if ok {
+			downloaded = append(downloaded, p)
+		}
+		return p, err
+	})
+	if err == nil {
+		return nil
+	}
+	for _, p := range downloaded {
+		os.Remove(p)
+		os.Remove(p + ".meta")
+	}
+
+	var backups []string
+	berr := parse(func(file string) (string, error) {
+		if !isRemoteFile(file) {
+			return file, nil
+		}
+		p := c.path(file)
+		if fileExists(p + ".bak") {
+			backups = append(backups, file)
+			return p + ".bak", nil
+		}
+		if !fileExists(p) { // don't download it again
+			return "", fmt.Errorf("%s has no cached copy", file)
+		}
+		return p, nil
+	})
+	if len(backups) == 0 || berr != nil {
+		return err
+	}
+	for _, u := range backups { // the next refresh downloads them unconditionally
+		os.Remove(c.path(u) + ".meta")
+	}
+	mlog.S().Warnf("%v, using the last good copies of %s", err, strings.Join(backups, ", "))
+	return nil
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// stale reports whether the cached file of u is older than d.
+func (c *remoteCache) stale(u string, d time.Duration) bool {
+	fi, err := os.Stat(c.path(u))
+	if err != nil {
+		return true
+	}
+	return time.Since(fi.ModTime()) > d
+}
+
+// fetch downloads u to the cache dir. changed is false if the server
+// replied that the cached file is not modified. If check is not nil, it
+// is called with the downloaded file before it replaces the cached one.
+// If fetch fails, the cached file is kept.
+func (c *remoteCache) fetch(ctx context.Context, u string, check func(file string) error) (changed bool, err error) {
+	p := c.path(u)
+	metaFile := p + ".meta"
+	meta := new(remoteFileMeta)
+	if _, err := os.Stat(p); err == nil {
+		if b, err := os.ReadFile(metaFile); err == nil {
+			json.Unmarshal(b, meta)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, err
+	}
+	if len(meta.ETag) > 0 {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if len(meta.LastModified) > 0 {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		now := time.Now()
+		os.Chtimes(p, now, now) // reset the stale timer
+		return false, nil
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("http status %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return false, err
+	}
+	// write to a temp file first, so the cached file is always complete.
+	f, err := os.CreateTemp(c.dir, ".download_*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return false, err
+	}
+	n, err := io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	if n == 0 { // never replace a good copy with an empty file
+		return false, errors.New("empty response")
+	}
+	if check != nil {
+		if err := check(f.Name()); err != nil {
+			return false, fmt.Errorf("invalid file, %w", err)
+		}
+	}
+	if fileExists(p) { // keep the last good copy, see withBackup.
+		os.Remove(p + ".bak")
+		if err := os.Link(p, p+".bak"); err != nil {
+			mlog.S().Warnf("failed to back up %s, %v", p, err)
+		}
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return false, err
+	}
+
+	meta = &remoteFileMeta{
+		URL:          u,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(metaFile, b, 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// remoteRefresher downloads remote rule files periodically and reloads
+// the rule sets that use them.
+type remoteRefresher struct {
+	c        *remoteCache
+	interval time.Duration
+	sets     map[string][]ruleSet // key is the url
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newRemoteRefresher starts refreshing remote files of sets. It returns
+// nil if sets have no remote file.
+func newRemoteRefresher(c *remoteCache, sets []ruleSet, interval time.Duration) *remoteRefresher {
+	m := make(map[string][]ruleSet)
+	for _, s := range sets {
+		for _, f := range s.Files() {
+			if isRemoteFile(f) {
+				m[f] = append(m[f], s)
+			}
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &remoteRefresher{c: c, interval: interval, sets: m, ctx: ctx, cancel: cancel}
+	go r.run()
+	return r
+}
+
+func (r *remoteRefresher) run() {
+	r.refresh(true) // files may be outdated since last run.
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.refresh(false)
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *remoteRefresher) refresh(staleOnly bool) {
+	changed := make(map[ruleSet]struct{})
+	for u, sets := range r.sets {
+		if staleOnly && !r.c.stale(u, r.interval) {
+			continue
+		}
+		ok, err := r.c.fetch(r.ctx, u, func(file string) error {
+			return r.check(u, file)
+		})
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			mlog.S().Warnf("failed to update %s, keep using the cached copy, %v", u, err)
+			continue
+		}
+		if !ok {
+			mlog.S().Debugf("%s is not modified", u)
+			continue
+		}
+		mlog.S().Infof("%s updated", u)
+		for _, s := range sets {
+			changed[s] = struct{}{}
+		}
+	}
+	if r.ctx.Err() == nil {
+		reloadRuleSets(changed)
+	}
+}
+
+// check parses file, the download of u, with every set that uses u.
+func (r *remoteRefresher) check(u, file string) error {
+	localFile := func(f string) (string, error) {
+		if f == u {
+			return file, nil
+		}
+		return r.c.localFile(f)
+	}
+	for _, s := range r.sets[u] {
+		if err := s.check(localFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the refreshing.
+func (r *remoteRefresher) Close() error {
+	r.cancel()
+	return nil
+}
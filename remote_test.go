@@ -0,0 +1,335 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ruleServer is a http server of a rule file.
+type ruleServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	body     string
+	status   int // 0 means http.StatusOK
+	etag     string
+	modified string
+	reqs     []*http.Request
+}
+
+func newRuleServer(t *testing.T, body string) *ruleServer {
+	t.Helper()
+	s := &ruleServer{body: body, etag: `"v1"`, modified: ruleServerTime.Format(http.TimeFormat)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.reqs = append(s.reqs, r)
+		if s.status != 0 {
+			w.WriteHeader(s.status)
+			return
+		}
+		if r.Header.Get("If-None-Match") == s.etag || r.Header.Get("If-Modified-Since") == s.modified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", s.etag)
+		w.Header().Set("Last-Modified", s.modified)
+		w.Write([]byte(s.body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+var ruleServerTime = time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// set changes the file on the server. Its modified time is one hour
+// later than the last change.
+func (s *ruleServer) set(body string, status int, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.status, s.etag = body, status, etag
+	t, _ := http.ParseTime(s.modified)
+	s.modified = t.Add(time.Hour).Format(http.TimeFormat)
+}
+
+func (s *ruleServer) requests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.reqs...)
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func Test_remoteCache_fetch(t *testing.T) {
+	s := newRuleServer(t, "domain:a.com\n")
+	c := newRemoteCache(t.TempDir())
+	u := s.URL + "/ads.txt"
+
+	p, err := c.localFile(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, p); got != "domain:a.com\n" {
+		t.Fatalf("unexpected cached file %q", got)
+	}
+	if len(s.requests()) != 1 {
+		t.Fatalf("want 1 request, got %d", len(s.requests()))
+	}
+
+	// cached files are used without requests.
+	if _, err := c.localFile(u); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.requests()) != 1 {
+		t.Fatalf("cached file should be used, got %d requests", len(s.requests()))
+	}
+
+	// revalidation
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(p, old, old); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := c.fetch(context.Background(), u, nil)
+	if err != nil || changed {
+		t.Fatalf("want not modified, got changed: %v, err: %v", changed, err)
+	}
+	reqs := s.requests()
+	r := reqs[len(reqs)-1]
+	if got := r.Header.Get("If-None-Match"); got != `"v1"` {
+		t.Fatalf("unexpected If-None-Match %q", got)
+	}
+	if got := r.Header.Get("If-Modified-Since"); got != ruleServerTime.Format(http.TimeFormat) {
+		t.Fatalf("unexpected If-Modified-Since %q", got)
+	}
+	if c.stale(u, time.Minute) {
+		t.Fatal("the stale timer should be reset by a 304 response")
+	}
+
+	// modified
+	s.set("domain:b.com\n", 0, `"v2"`)
+	changed, err = c.fetch(context.Background(), u, nil)
+	if err != nil || !changed {
+		t.Fatalf("want changed, got changed: %v, err: %v", changed, err)
+	}
+	if got := readFile(t, p); got != "domain:b.com\n" {
+		t.Fatalf("unexpected cached file %q", got)
+	}
+
+	// failed or empty downloads never replace the good copy.
+	for _, tt := range []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"server error", "", http.StatusInternalServerError},
+		{"not found", "", http.StatusNotFound},
+		{"empty", "", 0},
+	} {
+		s.set(tt.body, tt.status, `"v3"`)
+		if _, err := c.fetch(context.Background(), u, nil); err == nil {
+			t.Fatalf("%s: want an error", tt.name)
+		}
+		if got := readFile(t, p); got != "domain:b.com\n" {
+			t.Fatalf("%s: the cached file is replaced by %q", tt.name, got)
+		}
+		if _, err := c.localFile(u); err != nil {
+			t.Fatalf("%s: the cached file should be used, %v", tt.name, err)
+		}
+	}
+}
+
+func Test_remoteCache_fetchFailed(t *testing.T) {
+	s := newRuleServer(t, "")
+	s.set("", http.StatusInternalServerError, "")
+	c := newRemoteCache(t.TempDir())
+	if _, err := c.localFile(s.URL + "/ads.txt"); err == nil {
+		t.Fatal("want an error if there is no cached copy")
+	}
+}
+
+func Test_remoteCache_invalidDownload(t *testing.T) {
+	s := newRuleServer(t, "1.1.1.0/24\n")
+	c := newRemoteCache(t.TempDir())
+	u := s.URL + "/ip.txt"
+	set, err := newIPSet("test", []string{u}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := c.path(u)
+	r := &remoteRefresher{c: c, sets: map[string][]ruleSet{u: {set}}}
+	check := func(file string) error { return r.check(u, file) }
+
+	// a download that the set can not parse never replaces the good copy.
+	s.set("<html>captive portal</html>\n", 0, `"v2"`)
+	if _, err := c.fetch(context.Background(), u, check); err == nil {
+		t.Fatal("want an error")
+	}
+	if got := readFile(t, p); got != "1.1.1.0/24\n" {
+		t.Fatalf("the cached file is replaced by %q", got)
+	}
+	if fileExists(p + ".bak") {
+		t.Fatal("unexpected backup")
+	}
+
+	// the good copy is backed up when it is replaced.
+	s.set("2.2.2.0/24\n", 0, `"v3"`)
+	if changed, err := c.fetch(context.Background(), u, check); err != nil || !changed {
+		t.Fatalf("want changed, got changed: %v, err: %v", changed, err)
+	}
+	if got := readFile(t, p); got != "2.2.2.0/24\n" {
+		t.Fatalf("unexpected cached file %q", got)
+	}
+	if got := readFile(t, p+".bak"); got != "1.1.1.0/24\n" {
+		t.Fatalf("unexpected backup %q", got)
+	}
+
+	// a broken cached copy falls back to the backup.
+	if err := os.WriteFile(p, []byte("<html>\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	set, err = newIPSet("test", []string{u}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := set.Match(net.ParseIP("1.1.1.1")); !ok {
+		t.Fatal("the backup is not loaded")
+	}
+}
+
+func Test_remoteCache_invalidFirstDownload(t *testing.T) {
+	s := newRuleServer(t, "<html>captive portal</html>\n")
+	c := newRemoteCache(t.TempDir())
+	u := s.URL + "/ip.txt"
+	if _, err := newIPSet("test", []string{u}, c); err == nil {
+		t.Fatal("want an error")
+	}
+	// it is not kept, so the next start downloads it again.
+	if fileExists(c.path(u)) {
+		t.Fatal("the invalid download is kept")
+	}
+	s.set("1.1.1.0/24\n", 0, `"v2"`)
+	if _, err := newIPSet("test", []string{u}, c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_remoteRefresher(t *testing.T) {
+	s := newRuleServer(t, "domain:a.com\n")
+	c := newRemoteCache(t.TempDir())
+	u := s.URL + "/ads.txt"
+	set, err := newDomainSet("test", []string{u}, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fresh cached file is not downloaded again on start.
+	interval := 200 * time.Millisecond
+	r := newRemoteRefresher(c, []ruleSet{set}, interval)
+	if r == nil {
+		t.Fatal("nil refresher")
+	}
+	defer r.Close()
+	time.Sleep(interval / 2)
+	if n := len(s.requests()); n != 1 {
+		t.Fatalf("want 1 request before the interval, got %d", n)
+	}
+
+	s.set("domain:a.com\ndomain:b.com\n", 0, `"v2"`)
+	deadline := time.Now().Add(5 * interval)
+	for set.Len() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the rule set is not reloaded, len: %d, requests: %d", set.Len(), len(s.requests()))
+		}
+		time.Sleep(interval / 10)
+	}
+
+	// keep the rules if the refresh fails.
+	s.set("", http.StatusInternalServerError, "")
+	n := len(s.requests())
+	for len(s.requests()) == n {
+		if time.Now().After(deadline.Add(5 * interval)) {
+			t.Fatal("no refresh request")
+		}
+		time.Sleep(interval / 10)
+	}
+	if set.Len() != 2 {
+		t.Fatalf("rules should be kept, len: %d", set.Len())
+	}
+
+	// and if the new file can not be parsed.
+	s.set("domain:c.com\nregexp:(\n", 0, `"v3"`)
+	n = len(s.requests())
+	for len(s.requests()) == n {
+		if time.Now().After(deadline.Add(10 * interval)) {
+			t.Fatal("no refresh request")
+		}
+		time.Sleep(interval / 10)
+	}
+	if set.Len() != 2 {
+		t.Fatalf("rules should be kept, len: %d", set.Len())
+	}
+	if got := readFile(t, c.path(u)); got != "domain:a.com\ndomain:b.com\n" {
+		t.Fatalf("the cached file is replaced by %q", got)
+	}
+}
+
+func Test_splitRuleFile(t *testing.T) {
+	for _, tt := range []struct {
+		s, file, tag string
+		ok           bool
+	}{
+		{"geosite.dat:cn", "geosite.dat", "cn", true},
+		{"ads.txt", "ads.txt", "", false},
+		{"https://example.com/geosite.dat:cn", "https://example.com/geosite.dat", "cn", true},
+		{"https://example.com:8443/geosite.dat:cn", "https://example.com:8443/geosite.dat", "cn", true},
+		{"https://example.com:8443/ads.txt", "https://example.com:8443/ads.txt", "", false},
+		{"http://example.com/geosite.dat:geolocation-!cn", "http://example.com/geosite.dat", "geolocation-!cn", true},
+	} {
+		file, tag, ok := splitRuleFile(tt.s)
+		if file != tt.file || tag != tt.tag || ok != tt.ok {
+			t.Errorf("splitRuleFile(%q) = %q, %q, %v, want %q, %q, %v", tt.s, file, tag, ok, tt.file, tt.tag, tt.ok)
+		}
+	}
+}
+
+func Test_ruleFilePath(t *testing.T) {
+	for s, want := range map[string]string{
+		"abp:https://example.com/easylist.txt": "https://example.com/easylist.txt",
+		"hostsfile:/etc/hosts":                 "/etc/hosts",
+		"https://example.com/geosite.dat:cn":   "https://example.com/geosite.dat",
+	} {
+		if got := ruleFilePath(s); got != want {
+			t.Errorf("ruleFilePath(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,641 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/hosts"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/load_cache"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/v2data"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/utils"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ruleSet is a set of rules that loaded from files.
+type ruleSet interface {
+	Tag() string
+	// Files returns the file paths that the rules were loaded from.
+	Files() []string
+	Len() int
+
+	// load (re)loads the rules from files. It is not concurrent safe,
+	// see reloadRuleSets.
+	// If it fails, the current rules will be kept.
+	load() (added, removed int, err error)
+	// check parses the rules like load, but does not use them. Files
+	// are read from the paths that localFile returns.
+	check(localFile localFileFunc) error
+}
+
+// diffRules returns the number of rules that are in new but not in old,
+// and the number of rules that are in old but not in new.
+func diffRules(old, new map[string]struct{}) (added, removed int) {
+	for r := range new {
+		if _, ok := old[r]; !ok {
+			added++
+		}
+	}
+	for r := range old {
+		if _, ok := new[r]; !ok {
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// splitRuleFile splits a rule file arg to the file path and the tag.
+// v2ray data file args have a tag suffix. e.g. "geosite.dat:cn",
+// "https://example.com/geosite.dat:cn".
+func splitRuleFile(s string) (file, tag string, ok bool) {
+	i := 0
+	if isRemoteFile(s) {
+		i = strings.LastIndex(s, "/")
+	}
+	j := strings.Index(s[i:], ":")
+	if j < 0 {
+		return s, "", false
+	}
+	return s[:i+j], s[i+j+1:], true
+}
+
+// ruleFilePath returns the file path of a rule file arg.
+func ruleFilePath(s string) string {
+	_, s = splitDomainFormat(s)
+	file, _, _ := splitRuleFile(s)
+	return file
+}
+
+// reloadMu serializes reloads of rule sets from the file watchers and
+// the remote refreshers.
+var reloadMu sync.Mutex
+
+// reloadRuleSets reloads sets and logs the changes.
+func reloadRuleSets(sets map[ruleSet]struct{}) {
+	if len(sets) == 0 {
+		return
+	}
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	for s := range sets {
+		added, removed, err := s.load()
+		if err != nil {
+			mlog.S().Errorf("failed to reload %s, keep using the old rules, %v", s.Tag(), err)
+			continue
+		}
+		mlog.S().Infof("%s reloaded, %d rules added, %d rules removed, total length: %d", s.Tag(), added, removed, s.Len())
+	}
+	load_cache.GetCache().Purge()
+}
+
+// readRuleLines reads a text rule file. Comments and empty lines are omitted.
+func readRuleLines(file string) ([]string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		s := utils.RemoveComment(scanner.Text(), "#")
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		lines = append(lines, s)
+	}
+	return lines, scanner.Err()
+}
+
+// domainSet is a domain matcher that can be reloaded at runtime.
+type domainSet struct {
+	tag    string
+	files  []string
+	remote *remoteCache
+	m      atomic.Value // *domainRules
+	rules  map[string]struct{}
+}
+
+type domainRules struct {
+	m          *domain.MixMatcher[struct{}]
+	exceptions *domain.MixMatcher[struct{}] // abp exception rules
+}
+
+var _ domain.Matcher[struct{}] = (*domainSet)(nil)
+
+// newDomainSet loads a domainSet from files. Files can be v2ray
+// geosite.dat files, text files, abp files or hosts files. The format
+// of text files can be specified by a prefix (see splitDomainFormat),
+// or it will be detected.
+func newDomainSet(tag string, files []string, remote *remoteCache) (*domainSet, error) {
+	s := &domainSet{tag: tag, files: files, remote: remote}
+	if _, _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *domainSet) Tag() string {
+	return s.tag
+}
+
+func (s *domainSet) Files() []string {
+	ps := make([]string, 0, len(s.files))
+	for _, f := range s.files {
+		ps = append(ps, ruleFilePath(f))
+	}
+	return ps
+}
+
+func (s *domainSet) load() (added, removed int, err error) {
+	var dr *domainRules
+	var rules map[string]struct{}
+	err = s.remote.withBackup(func(localFile localFileFunc) (err error) {
+		dr, rules, err = s.parse(localFile)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	added, removed = diffRules(s.rules, rules)
+	s.m.Store(dr)
+	s.rules = rules
+	return added, removed, nil
+}
+
+func (s *domainSet) check(localFile localFileFunc) error {
+	_, _, err := s.parse(localFile)
+	return err
+}
+
+func (s *domainSet) parse(localFile localFileFunc) (*domainRules, map[string]struct{}, error) {
+	dr := &domainRules{
+		m:          domain.NewMixMatcher[struct{}](),
+		exceptions: domain.NewMixMatcher[struct{}](),
+	}
+	rules := make(map[string]struct{})
+	for _, f := range s.files {
+		if err := loadDomainFile(dr, localFile, f, rules); err != nil {
+			return nil, nil, fmt.Errorf("failed to load domain file %s: %w", f, err)
+		}
+	}
+	return dr, rules, nil
+}
+
+func (s *domainSet) current() *domainRules {
+	return s.m.Load().(*domainRules)
+}
+
+func (s *domainSet) Match(d string) (struct{}, bool) {
+	return s.current().m.Match(d)
+}
+
+func (s *domainSet) Len() int {
+	dr := s.current()
+	return dr.m.Len() + dr.exceptions.Len()
+}
+
+func (s *domainSet) Add(_ string, _ struct{}) error {
+	return errors.New("domain set is read-only")
+}
+
+// exceptions returns a matcher of the exception rules in abp files of s.
+func (s *domainSet) exceptions() domain.Matcher[struct{}] {
+	return domainSetExceptions{s: s}
+}
+
+type domainSetExceptions struct {
+	s *domainSet
+}
+
+func (e domainSetExceptions) Match(d string) (struct{}, bool) {
+	return e.s.current().exceptions.Match(d)
+}
+
+func (e domainSetExceptions) Len() int {
+	return e.s.current().exceptions.Len()
+}
+
+func (e domainSetExceptions) Add(_ string, _ struct{}) error {
+	return errors.New("domain set is read-only")
+}
+
+// loadDomainFile loads rules from file to dr and records them in rules.
+func loadDomainFile(dr *domainRules, localFile localFileFunc, file string, rules map[string]struct{}) error {
+	format, file := splitDomainFormat(file)
+	file, tag, isDAT := splitRuleFile(file)
+	file, err := localFile(file)
+	if err != nil {
+		return err
+	}
+	if isDAT {
+		return loadDomainDAT(dr.m, file, tag, rules)
+	}
+
+	lines, err := readRuleLines(file)
+	if err != nil {
+		return err
+	}
+	if len(format) == 0 {
+		format = detectDomainFormat(lines)
+	}
+	ruleLines, exceptions, skipped := convertDomainLines(format, lines)
+	if skipped > 0 {
+		mlog.S().Debugf("%d unsupported rules in %s file %s are skipped", skipped, format, file)
+	}
+	for i, l := range ruleLines {
+		if err := dr.m.Add(l, struct{}{}); err != nil {
+			return fmt.Errorf("invalid rule #%d %s: %w", i, l, err)
+		}
+		rules[l] = struct{}{}
+	}
+	for i, l := range exceptions {
+		if err := dr.exceptions.Add(l, struct{}{}); err != nil {
+			return fmt.Errorf("invalid exception rule #%d %s: %w", i, l, err)
+		}
+		rules["@@"+l] = struct{}{}
+	}
+	return nil
+}
+
+// loadDomainDAT loads domains from a v2ray geosite.dat file. tag is
+// the category with optional attributes. e.g. "cn", "google@ads".
+func loadDomainDAT(m *domain.MixMatcher[struct{}], file, tag string, rules map[string]struct{}) error {
+	ss := strings.Split(tag, "@")
+	geoSite, err := domain.LoadGeoSiteFromDAT(file, ss[0])
+	if err != nil {
+		return err
+	}
+	am := make(map[string]struct{})
+	for _, attr := range ss[1:] {
+		am[attr] = struct{}{}
+	}
+
+getDomainLoop:
+	for i, d := range geoSite.GetDomain() {
+		for _, attr := range d.Attribute {
+			if _, ok := am[attr.Key]; !ok {
+				continue getDomainLoop
+			}
+		}
+
+		var typ string
+		switch d.Type {
+		case v2data.Domain_Plain:
+			typ = domain.MatcherKeyword
+		case v2data.Domain_Regex:
+			typ = domain.MatcherRegexp
+		case v2data.Domain_Domain:
+			typ = domain.MatcherDomain
+		case v2data.Domain_Full:
+			typ = domain.MatcherFull
+		default:
+			return fmt.Errorf("invalid v2ray Domain_Type %d", d.Type)
+		}
+		rule := typ + ":" + d.Value
+		if err := m.Add(rule, struct{}{}); err != nil {
+			return fmt.Errorf("failed to load value #%d, %w", i, err)
+		}
+		rules[rule] = struct{}{}
+	}
+	return nil
+}
+
+// ipSet is an ip matcher that can be reloaded at runtime.
+type ipSet struct {
+	tag    string
+	files  []string
+	remote *remoteCache
+	l      atomic.Value // *netlist.List
+	rules  map[string]struct{}
+}
+
+var _ netlist.Matcher = (*ipSet)(nil)
+
+// newIPSet loads an ipSet from files. Files can be v2ray geoip.dat
+// files or text files. An ip or a CIDR can also be used as a file.
+func newIPSet(tag string, files []string, remote *remoteCache) (*ipSet, error) {
+	s := &ipSet{tag: tag, files: files, remote: remote}
+	if _, _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ipSet) Tag() string {
+	return s.tag
+}
+
+func (s *ipSet) Files() []string {
+	ps := make([]string, 0, len(s.files))
+	for _, f := range s.files {
+		if isInlineIP(f) {
+			continue
+		}
+		ps = append(ps, ruleFilePath(f))
+	}
+	return ps
+}
+
+// isInlineIP reports whether s is an ip or a CIDR instead of a file.
+func isInlineIP(s string) bool {
+	if _, err := netip.ParseAddr(s); err == nil {
+		return true
+	}
+	_, err := netip.ParsePrefix(s)
+	return err == nil
+}
+
+func (s *ipSet) load() (added, removed int, err error) {
+	var l *netlist.List
+	var rules map[string]struct{}
+	err = s.remote.withBackup(func(localFile localFileFunc) (err error) {
+		l, rules, err = s.parse(localFile)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	added, removed = diffRules(s.rules, rules)
+	s.l.Store(l)
+	s.rules = rules
+	return added, removed, nil
+}
+
+func (s *ipSet) check(localFile localFileFunc) error {
+	_, _, err := s.parse(localFile)
+	return err
+}
+
+func (s *ipSet) parse(localFile localFileFunc) (*netlist.List, map[string]struct{}, error) {
+	l := netlist.NewList()
+	rules := make(map[string]struct{})
+	for _, f := range s.files {
+		if err := loadIPFile(l, localFile, f, rules); err != nil {
+			return nil, nil, fmt.Errorf("failed to load ip file %s: %w", f, err)
+		}
+	}
+	l.Sort()
+	return l, rules, nil
+}
+
+func (s *ipSet) list() *netlist.List {
+	return s.l.Load().(*netlist.List)
+}
+
+func (s *ipSet) Match(ip net.IP) (bool, error) {
+	return s.list().Match(ip)
+}
+
+func (s *ipSet) Len() int {
+	return s.list().Len()
+}
+
+// loadIPFile loads ip from file to l and records them in rules.
+func loadIPFile(l *netlist.List, localFile localFileFunc, file string, rules map[string]struct{}) error {
+	if isInlineIP(file) {
+		rules[file] = struct{}{}
+		return netlist.LoadFromText(l, file)
+	}
+	file, tag, isDAT := splitRuleFile(file)
+	file, err := localFile(file)
+	if err != nil {
+		return err
+	}
+	if isDAT {
+		geoIP, err := netlist.LoadGeoIPFromDAT(file, tag)
+		if err != nil {
+			return err
+		}
+		for _, c := range geoIP.GetCidr() {
+			rules[net.IP(c.Ip).String()+"/"+strconv.Itoa(int(c.Prefix))] = struct{}{}
+		}
+		return netlist.LoadFromV2CIDR(l, geoIP.GetCidr())
+	}
+
+	lines, err := readRuleLines(file)
+	if err != nil {
+		return err
+	}
+	for i, s := range lines {
+		s = utils.RemoveComment(s, " ")
+		if err := netlist.LoadFromText(l, s); err != nil {
+			return fmt.Errorf("invalid data at line #%d: %w", i, err)
+		}
+		rules[s] = struct{}{}
+	}
+	return nil
+}
+
+// hostsSet is a hosts executable that can be reloaded at runtime.
+type hostsSet struct {
+	tag    string
+	files  []string
+	remote *remoteCache
+	h      atomic.Value // *hostsTable
+	rules  map[string]struct{}
+}
+
+// hostsTable is the loaded hosts.
+type hostsTable struct {
+	h   *hosts.Hosts
+	ptr map[netip.Addr][]string // ip -> fqdn, from full match rules
+}
+
+var _ handler.Executable = (*hostsSet)(nil)
+
+// newHostsSet loads a hostsSet from files. A line of the files can be
+// in the mosdns format "domain ip..." or in the system format
+// "ip name [aliases...]". Files with the prefix "hostsfile:" must be
+// in the system format.
+func newHostsSet(tag string, files []string, remote *remoteCache) (*hostsSet, error) {
+	s := &hostsSet{tag: tag, files: files, remote: remote}
+	if _, _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *hostsSet) Tag() string {
+	return s.tag
+}
+
+func (s *hostsSet) Files() []string {
+	ps := make([]string, 0, len(s.files))
+	for _, f := range s.files {
+		_, f = splitDomainFormat(f)
+		ps = append(ps, f)
+	}
+	return ps
+}
+
+func (s *hostsSet) load() (added, removed int, err error) {
+	var t *hostsTable
+	var rules map[string]struct{}
+	err = s.remote.withBackup(func(localFile localFileFunc) (err error) {
+		t, rules, err = s.parse(localFile)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	added, removed = diffRules(s.rules, rules)
+	s.h.Store(t)
+	s.rules = rules
+	return added, removed, nil
+}
+
+func (s *hostsSet) check(localFile localFileFunc) error {
+	_, _, err := s.parse(localFile)
+	return err
+}
+
+func (s *hostsSet) parse(localFile localFileFunc) (*hostsTable, map[string]struct{}, error) {
+	m := domain.NewMixMatcher[*hosts.IPs]()
+	m.SetDefaultMatcher(domain.MatcherFull)
+	ptr := make(map[netip.Addr][]string)
+	rules := make(map[string]struct{})
+	system := make(map[string]*hosts.IPs) // names in the system format, they are added at last
+	var systemNames []string              // keep the order of names
+	for _, f := range s.files {
+		format, f := splitDomainFormat(f)
+		lf, err := localFile(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		lines, err := readRuleLines(lf)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, l := range lines {
+			fs := strings.Fields(l)
+			ip, ipErr := netip.ParseAddr(fs[0])
+			switch {
+			case ipErr == nil && len(fs) >= 2: // system format
+				ip = ip.Unmap()
+				for _, name := range fs[1:] {
+					name = dns.Fqdn(strings.ToLower(name))
+					ips := system[name]
+					if ips == nil {
+						ips = new(hosts.IPs)
+						system[name] = ips
+						systemNames = append(systemNames, name)
+					}
+					if ip.Is4() {
+						ips.IPv4 = append(ips.IPv4, ip)
+					} else {
+						ips.IPv6 = append(ips.IPv6, ip)
+					}
+					ptr[ip] = append(ptr[ip], name)
+				}
+			case format == domainFormatHosts:
+				return nil, nil, fmt.Errorf("failed to load hosts file %s, invalid rule #%d %s: not in the system hosts format", f, i, l)
+			default:
+				if err := domain.LoadFromText[*hosts.IPs](m, l, hosts.ParseIPs); err != nil {
+					return nil, nil, fmt.Errorf("failed to load hosts file %s, invalid rule #%d %s: %w", f, i, l, err)
+				}
+				name, ok := fullMatchName(fs[0])
+				ips, err := hosts.ParseIPs(strings.Join(fs[1:], " "))
+				if ok && err == nil {
+					for _, ip := range append(ips.IPv4, ips.IPv6...) {
+						ptr[ip] = append(ptr[ip], name)
+					}
+				}
+			}
+			rules[l] = struct{}{}
+		}
+	}
+	for _, name := range systemNames {
+		if err := m.Add(domain.MatcherFull+":"+name, system[name]); err != nil {
+			return nil, nil, fmt.Errorf("failed to add hosts %s, %w", name, err)
+		}
+	}
+	return &hostsTable{h: hosts.NewHosts(m), ptr: ptr}, rules, nil
+}
+
+// fullMatchName returns the fqdn of a full match domain rule.
+func fullMatchName(rule string) (string, bool) {
+	typ, name, ok := strings.Cut(rule, ":")
+	if !ok {
+		return dns.Fqdn(strings.ToLower(rule)), true
+	}
+	if typ != domain.MatcherFull {
+		return "", false
+	}
+	return dns.Fqdn(strings.ToLower(name)), true
+}
+
+func (s *hostsSet) Len() int {
+	return len(s.rules)
+}
+
+func (s *hostsSet) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	t := s.h.Load().(*hostsTable)
+	q := qCtx.Q()
+	r := t.h.LookupMsg(q)
+	if r == nil {
+		r = t.lookupPTR(q)
+	}
+	if r != nil {
+		qCtx.SetResponse(r, handler.ContextStatusResponded)
+		qCtx.AddMark(markRouteHosts)
+		return nil
+	}
+	return handler.ExecChainNode(ctx, qCtx, next)
+}
+
+// lookupPTR returns the PTR response of q. It returns nil if q is not a
+// PTR query or the ip is not in the hosts.
+func (t *hostsTable) lookupPTR(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 || q.Question[0].Qtype != dns.TypePTR || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+	ip, ok := parsePTRName(question.Name)
+	if !ok {
+		return nil
+	}
+	names := t.ptr[ip]
+	if len(names) == 0 {
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	for _, name := range names {
+		r.Answer = append(r.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 3600},
+			Ptr: name,
+		})
+	}
+	return r
+}
@@ -0,0 +1,204 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/miekg/dns"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+const testHosts = `# system format
+192.168.1.10  nas nas.lan   # inline comment
+192.168.1.11  printer.lan
+fd00::10      nas.lan
+::ffff:192.168.1.12 tv.lan
+
+# mosdns format
+router.lan 192.168.1.1 fd00::1
+domain:corp.lan 10.0.0.1
+`
+
+// noReply is the rest of the chain that does not reply.
+var noReply = &fakeUpstream{reply: func(*dns.Msg) *dns.Msg { return nil }}
+
+func newTestHostsSet(t *testing.T, files ...string) *hostsSet {
+	t.Helper()
+	var args []string
+	for i, body := range files {
+		p := filepath.Join(t.TempDir(), "hosts"+string(rune('0'+i)))
+		if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, p)
+	}
+	s, err := newHostsSet("hosts", args, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func answerStrings(r *dns.Msg) []string {
+	var ss []string
+	for _, rr := range r.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ss = append(ss, rr.A.String())
+		case *dns.AAAA:
+			ss = append(ss, rr.AAAA.String())
+		case *dns.PTR:
+			ss = append(ss, rr.Ptr)
+		}
+	}
+	sort.Strings(ss)
+	return ss
+}
+
+func Test_hostsSet_load(t *testing.T) {
+	s := newTestHostsSet(t, testHosts)
+	if s.Len() != 6 {
+		t.Fatalf("Len() = %d, want 6", s.Len())
+	}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []string // nil means not in the hosts
+	}{
+		{"nas.", dns.TypeA, []string{"192.168.1.10"}},
+		{"NAS.lan.", dns.TypeA, []string{"192.168.1.10"}},
+		{"nas.lan.", dns.TypeAAAA, []string{"fd00::10"}},
+		{"printer.lan.", dns.TypeA, []string{"192.168.1.11"}},
+		{"tv.lan.", dns.TypeA, []string{"192.168.1.12"}},
+		{"router.lan.", dns.TypeA, []string{"192.168.1.1"}},
+		{"router.lan.", dns.TypeAAAA, []string{"fd00::1"}},
+		{"www.corp.lan.", dns.TypeA, []string{"10.0.0.1"}},
+		{"sub.nas.lan.", dns.TypeA, nil}, // system names are full matches
+		{"comment.", dns.TypeA, nil},
+		{"other.lan.", dns.TypeA, nil},
+	}
+	for _, tt := range tests {
+		r := execQuery(t, s, noReply, tt.name, tt.qtype)
+		if tt.want == nil {
+			if r != nil {
+				t.Errorf("%s %s: unexpected reply %v", tt.name, dns.TypeToString[tt.qtype], r)
+			}
+			continue
+		}
+		if r == nil {
+			t.Errorf("%s %s: no reply", tt.name, dns.TypeToString[tt.qtype])
+			continue
+		}
+		if got := answerStrings(r); !equalStrings(got, tt.want) {
+			t.Errorf("%s %s: got %v, want %v", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+		}
+	}
+}
+
+func Test_hostsSet_systemFormatOnly(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(p, []byte("router.lan 192.168.1.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newHostsSet("hosts", []string{"hostsfile:" + p}, nil); err == nil {
+		t.Fatal("a mosdns format line in a hostsfile: file is loaded")
+	}
+}
+
+func Test_hostsSet_lookupPTR(t *testing.T) {
+	s := newTestHostsSet(t, testHosts)
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"10.1.168.192.in-addr.arpa.", []string{"nas.", "nas.lan."}},
+		{"12.1.168.192.in-addr.arpa.", []string{"tv.lan."}},
+		{"1.1.168.192.in-addr.arpa.", []string{"router.lan."}},
+		{"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", []string{"nas.lan."}},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.D.F.IP6.ARPA.", []string{"router.lan."}},
+		{"1.0.0.10.in-addr.arpa.", nil}, // from a domain rule, not a full name
+		{"99.1.168.192.in-addr.arpa.", nil},
+	}
+	for _, tt := range tests {
+		r := execQuery(t, s, noReply, tt.name, dns.TypePTR)
+		if tt.want == nil {
+			if r != nil {
+				t.Errorf("%s: unexpected reply %v", tt.name, r)
+			}
+			continue
+		}
+		if r == nil {
+			t.Errorf("%s: no reply", tt.name)
+			continue
+		}
+		if got := answerStrings(r); !equalStrings(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if r.Answer[0].Header().Name != tt.name {
+			t.Errorf("%s: unexpected owner name %s", tt.name, r.Answer[0].Header().Name)
+		}
+	}
+}
+
+func Test_parsePTRName(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string // empty means invalid
+	}{
+		{"4.3.2.1.in-addr.arpa.", "1.2.3.4"},
+		{"4.3.2.1.in-addr.arpa", "1.2.3.4"},
+		{"4.3.2.1.IN-ADDR.ARPA.", "1.2.3.4"},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.0.0.0.0.0.0.0.0.ip6.arpa.", "0:0:2001:db8::1"},
+		{"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.", "4321:0:1:2:3:4:567:89ab"},
+		{"3.2.1.in-addr.arpa.", ""},
+		{"256.3.2.1.in-addr.arpa.", ""},
+		{"a.3.2.1.in-addr.arpa.", ""},
+		{"2.1.in-addr.arpa.", ""},
+		{"1.ip6.arpa.", ""},
+		{"g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.0.0.0.0.0.0.0.0.ip6.arpa.", ""},
+		{"example.com.", ""},
+	}
+	for _, tt := range tests {
+		ip, ok := parsePTRName(tt.name)
+		if len(tt.ip) == 0 {
+			if ok {
+				t.Errorf("parsePTRName(%q) = %s, want invalid", tt.name, ip)
+			}
+			continue
+		}
+		if want := netip.MustParseAddr(tt.ip); !ok || ip != want {
+			t.Errorf("parsePTRName(%q) = %s, %v, want %s", tt.name, ip, ok, want)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
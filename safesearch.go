@@ -0,0 +1,208 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// safeSearchTTL is the ttl of the CNAME records of safe search.
+const safeSearchTTL = 300
+
+// googleDomains are the search domains of Google.
+const googleDomains = "google.com google.ad google.ae google.com.af google.com.ag google.al google.am google.co.ao " +
+	"google.com.ar google.as google.at google.com.au google.az google.ba google.com.bd google.be google.bf google.bg " +
+	"google.com.bh google.bi google.bj google.com.bn google.com.bo google.com.br google.bs google.bt google.co.bw " +
+	"google.by google.com.bz google.ca google.cat google.cd google.cf google.cg google.ch google.ci google.co.ck " +
+	"google.cl google.cm google.cn google.com.co google.co.cr google.com.cu google.cv google.com.cy google.cz " +
+	"google.de google.dj google.dk google.dm google.com.do google.dz google.com.ec google.ee google.com.eg google.es " +
+	"google.com.et google.fi google.com.fj google.fm google.fr google.ga google.ge google.gg google.com.gh " +
+	"google.com.gi google.gl google.gm google.gr google.com.gt google.gy google.com.hk google.hn google.hr google.ht " +
+	"google.hu google.co.id google.ie google.co.il google.im google.co.in google.iq google.is google.it google.je " +
+	"google.com.jm google.jo google.co.jp google.co.ke google.com.kh google.ki google.kg google.co.kr google.com.kw " +
+	"google.kz google.la google.com.lb google.li google.lk google.co.ls google.lt google.lu google.lv google.com.ly " +
+	"google.co.ma google.md google.me google.mg google.mk google.ml google.com.mm google.mn google.com.mt google.mu " +
+	"google.mv google.mw google.com.mx google.com.my google.co.mz google.com.na google.com.ng google.com.ni google.ne " +
+	"google.nl google.no google.com.np google.nr google.nu google.co.nz google.com.om google.com.pa google.com.pe " +
+	"google.com.pg google.com.ph google.com.pk google.pl google.pn google.com.pr google.ps google.pt google.com.py " +
+	"google.com.qa google.ro google.rs google.ru google.rw google.com.sa google.com.sb google.sc google.se " +
+	"google.com.sg google.sh google.si google.sk google.com.sl google.sn google.so google.sm google.sr google.st " +
+	"google.com.sv google.td google.tg google.co.th google.com.tj google.tl google.tm google.tn google.to " +
+	"google.com.tr google.tt google.com.tw google.co.tz google.com.ua google.co.ug google.co.uk google.com.uy " +
+	"google.co.uz google.com.vc google.co.ve google.co.vi google.com.vn google.vu google.ws google.co.za " +
+	"google.co.zm google.co.zw"
+
+// builtinSafeSearch returns the built-in safe search table.
+func builtinSafeSearch() map[string]string {
+	t := make(map[string]string)
+	for _, d := range strings.Fields(googleDomains) {
+		t[d+"."] = "forcesafesearch.google.com."
+		t["www."+d+"."] = "forcesafesearch.google.com."
+	}
+	for _, d := range []string{"www.youtube.com", "m.youtube.com", "youtubei.googleapis.com",
+		"youtube.googleapis.com", "www.youtube-nocookie.com"} {
+		t[d+"."] = "restrict.youtube.com."
+	}
+	for _, d := range []string{"bing.com", "www.bing.com"} {
+		t[d+"."] = "strict.bing.com."
+	}
+	for _, d := range []string{"duckduckgo.com", "www.duckduckgo.com", "start.duckduckgo.com"} {
+		t[d+"."] = "safe.duckduckgo.com."
+	}
+	return t
+}
+
+// safeSearch is an executable that rewrites queries of search engines
+// to their safe search domains by CNAME records. The built-in table
+// can be overridden by files.
+type safeSearch struct {
+	tag    string
+	files  []string
+	remote *remoteCache
+	t      atomic.Value // map[string]string, lower case fqdn -> target
+	rules  map[string]struct{}
+}
+
+var (
+	_ ruleSet            = (*safeSearch)(nil)
+	_ handler.Executable = (*safeSearch)(nil)
+)
+
+// newSafeSearch loads a safeSearch from the built-in table and files.
+// Each line of files is a domain and its target. e.g.
+//
+//	www.youtube.com restrictmoderate.youtube.com
+func newSafeSearch(tag string, files []string, remote *remoteCache) (*safeSearch, error) {
+	s := &safeSearch{tag: tag, files: files, remote: remote}
+	if _, _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *safeSearch) Tag() string {
+	return s.tag
+}
+
+func (s *safeSearch) Files() []string {
+	return s.files
+}
+
+func (s *safeSearch) Len() int {
+	return len(s.rules)
+}
+
+func (s *safeSearch) load() (added, removed int, err error) {
+	var t map[string]string
+	err = s.remote.withBackup(func(localFile localFileFunc) (err error) {
+		t, err = s.parse(localFile)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	rules := make(map[string]struct{}, len(t))
+	for name, target := range t {
+		rules[name+" "+target] = struct{}{}
+	}
+	added, removed = diffRules(s.rules, rules)
+	s.t.Store(t)
+	s.rules = rules
+	return added, removed, nil
+}
+
+func (s *safeSearch) check(localFile localFileFunc) error {
+	_, err := s.parse(localFile)
+	return err
+}
+
+func (s *safeSearch) parse(localFile localFileFunc) (map[string]string, error) {
+	t := builtinSafeSearch()
+	for _, f := range s.files {
+		lf, err := localFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := loadSafeSearchFile(t, lf); err != nil {
+			return nil, fmt.Errorf("failed to load safe search file %s, %w", f, err)
+		}
+	}
+	return t, nil
+}
+
+func loadSafeSearchFile(t map[string]string, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 0; scanner.Scan(); {
+		line++
+		s := scanner.Text()
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			s = s[:i]
+		}
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid line %d: %s", line, scanner.Text())
+		}
+		t[strings.ToLower(dns.Fqdn(fields[0]))] = dns.Fqdn(fields[1])
+	}
+	return scanner.Err()
+}
+
+// Exec answers the query with a CNAME record to the safe search domain
+// and resolves the target by the rest of the chain.
+func (s *safeSearch) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	question := q.Question[0]
+	target, ok := s.t.Load().(map[string]string)[strings.ToLower(question.Name)]
+	if !ok {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	r.Answer = append(r.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: safeSearchTTL},
+		Target: target,
+	})
+	if question.Qtype != dns.TypeCNAME {
+		if err := resolveCNAMETarget(ctx, qCtx, next, r, target); err != nil {
+			return err
+		}
+	}
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	qCtx.AddMark(markRouteSafeSearch)
+	return nil
+}
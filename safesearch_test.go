@@ -0,0 +1,135 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSafeSearch(t *testing.T, files ...string) (*safeSearch, error) {
+	t.Helper()
+	var args []string
+	for i, body := range files {
+		p := filepath.Join(t.TempDir(), "safe_search"+string(rune('0'+i))+".txt")
+		if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, p)
+	}
+	return newSafeSearch("safe_search", args, nil)
+}
+
+func Test_builtinSafeSearch(t *testing.T) {
+	tb := builtinSafeSearch()
+	for name, want := range map[string]string{
+		"google.com.":           "forcesafesearch.google.com.",
+		"www.google.com.":       "forcesafesearch.google.com.",
+		"www.google.co.jp.":     "forcesafesearch.google.com.",
+		"google.com.hk.":        "forcesafesearch.google.com.",
+		"www.youtube.com.":      "restrict.youtube.com.",
+		"m.youtube.com.":        "restrict.youtube.com.",
+		"www.bing.com.":         "strict.bing.com.",
+		"duckduckgo.com.":       "safe.duckduckgo.com.",
+		"start.duckduckgo.com.": "safe.duckduckgo.com.",
+	} {
+		if got := tb[name]; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"mail.google.com.", "youtube.com.", "forcesafesearch.google.com.", "example.com."} {
+		if got, ok := tb[name]; ok {
+			t.Errorf("%s: unexpected target %q", name, got)
+		}
+	}
+}
+
+func Test_safeSearch_files(t *testing.T) {
+	s, err := newTestSafeSearch(t,
+		"# moderate for youtube\nwww.youtube.com restrictmoderate.youtube.com\n",
+		"WWW.Example.com safe.example.com. # inline comment\n\nm.youtube.com restrictmoderate.youtube.com\n",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := s.t.Load().(map[string]string)
+	for name, want := range map[string]string{
+		"www.youtube.com.": "restrictmoderate.youtube.com.",
+		"m.youtube.com.":   "restrictmoderate.youtube.com.",
+		"www.example.com.": "safe.example.com.",
+		"www.google.com.":  "forcesafesearch.google.com.", // the rest of the built-in table is kept
+	} {
+		if got := tb[name]; got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if s.Len() != len(builtinSafeSearch())+1 {
+		t.Errorf("Len() = %d, want %d", s.Len(), len(builtinSafeSearch())+1)
+	}
+
+	if _, err := newTestSafeSearch(t, "www.example.com\n"); err == nil {
+		t.Error("want an error for a line without a target")
+	}
+	if _, err := newTestSafeSearch(t, "www.example.com a.example.com b.example.com\n"); err == nil {
+		t.Error("want an error for a line with two targets")
+	}
+}
+
+func Test_safeSearch_Exec(t *testing.T) {
+	s, err := newTestSafeSearch(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CNAME to the target, then the target is resolved by the rest of the chain.
+	u := &targetUpstream{target: "forcesafesearch.google.com."}
+	r := execQuery(t, s, u, "WWW.Google.com.", dns.TypeA)
+	if r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 2 {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	if cname, ok := r.Answer[0].(*dns.CNAME); !ok || cname.Hdr.Name != "WWW.Google.com." || cname.Target != "forcesafesearch.google.com." || cname.Hdr.Ttl != safeSearchTTL {
+		t.Fatalf("unexpected answer %v", r.Answer[0])
+	}
+	if a, ok := r.Answer[1].(*dns.A); !ok || a.Hdr.Name != "forcesafesearch.google.com." {
+		t.Fatalf("unexpected answer %v", r.Answer[1])
+	}
+	if len(u.questions) != 1 || u.questions[0] != "forcesafesearch.google.com." {
+		t.Fatalf("unexpected upstream questions %v", u.questions)
+	}
+
+	// CNAME queries are answered without the upstream.
+	u = &targetUpstream{}
+	r = execQuery(t, s, u, "www.bing.com.", dns.TypeCNAME)
+	if r == nil || len(r.Answer) != 1 || len(u.questions) != 0 {
+		t.Fatalf("unexpected reply %v, upstream questions %v", r, u.questions)
+	}
+
+	// other names are passed on unchanged.
+	r = execQuery(t, s, u, "mail.google.com.", dns.TypeA)
+	if len(u.questions) != 1 || u.questions[0] != "mail.google.com." || r == nil || r.Rcode != dns.RcodeNameError || len(r.Answer) != 0 {
+		t.Fatalf("unexpected reply %v, upstream questions %v", r, u.questions)
+	}
+
+	// no reply for the target
+	r = execQuery(t, s, noReply, "www.youtube.com.", dns.TypeAAAA)
+	if r == nil || r.Rcode != dns.RcodeServerFailure || len(r.Answer) != 1 {
+		t.Fatalf("unexpected reply %v", r)
+	}
+}
@@ -0,0 +1,390 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/http_handler"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// listenAddrs is a string list. It can also be unmarshalled from a single
+// yaml string, which is the format of server addresses in previous versions.
+type listenAddrs []string
+
+func (a *listenAddrs) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*a = nil
+		if len(n.Value) > 0 {
+			*a = listenAddrs{n.Value}
+		}
+		return nil
+	}
+	return n.Decode((*[]string)(a))
+}
+
+// listenerSpec describes a server listener.
+type listenerSpec struct {
+	name     string // the original spec
+	protocol string // udp, tcp, tls, https, http or quic
+	addr     string
+	path     string // url path of a http or https listener
+	log      bool   // log and count the queries of this listener
+
+	// trustedProxies are the reverse proxies of a http listener.
+	// See forwardedHandler.
+	trustedProxies []netip.Prefix
+}
+
+// parseListenerSpec parses s in format "[protocol://]addr[/path][?log=true]".
+// If the protocol is omitted, s is a udp and a tcp listener.
+func parseListenerSpec(s string) ([]*listenerSpec, error) {
+	withProtocol := strings.Contains(s, "://")
+	rs := s
+	if !withProtocol {
+		rs = "udp://" + s
+	}
+	u, err := url.Parse(rs)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("missing listen address")
+	}
+
+	name, _, _ := strings.Cut(s, "?")
+	ls := &listenerSpec{
+		name:     name,
+		protocol: u.Scheme,
+		addr:     u.Host,
+		path:     u.Path,
+	}
+	if v := u.Query().Get("log"); len(v) > 0 {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log arg, %w", err)
+		}
+		ls.log = b
+	}
+
+	switch ls.protocol {
+	case "udp", "tcp", "tls", "quic":
+		if len(ls.path) > 0 {
+			return nil, fmt.Errorf("%s listener does not have an url path", ls.protocol)
+		}
+	case "https", "http":
+		if len(ls.path) == 0 {
+			ls.path = opt.DoHPath
+		}
+	default:
+		return nil, fmt.Errorf("unsupported protocol [%s]", ls.protocol)
+	}
+
+	if !withProtocol {
+		tcpLs := *ls
+		tcpLs.protocol = "tcp"
+		return []*listenerSpec{ls, &tcpLs}, nil
+	}
+	return []*listenerSpec{ls}, nil
+}
+
+// listenerSpecs returns all listeners in opt.
+func listenerSpecs() ([]*listenerSpec, error) {
+	ss := append([]string(nil), opt.ServerAddr...)
+	for _, s := range opt.TLSServerAddr {
+		ss = append(ss, "tls://"+s)
+	}
+	for _, s := range opt.DoHServerAddr {
+		if opt.DoHPlainHTTP {
+			ss = append(ss, "http://"+s)
+		} else {
+			ss = append(ss, "https://"+s)
+		}
+	}
+	for _, s := range opt.DoQServerAddr {
+		ss = append(ss, "quic://"+s)
+	}
+
+	trusted, err := parseTrustedProxies(opt.TrustedProxy)
+	if err != nil {
+		return nil, err
+	}
+	var specs []*listenerSpec
+	for _, s := range ss {
+		ls, err := parseListenerSpec(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server address [%s], %w", s, err)
+		}
+		for _, l := range ls {
+			if l.protocol == "http" {
+				l.trustedProxies = trusted
+			}
+		}
+		specs = append(specs, ls...)
+	}
+	return specs, nil
+}
+
+// requireTLS reports whether the listener needs a server certificate.
+func (ls *listenerSpec) requireTLS() bool {
+	switch ls.protocol {
+	case "tls", "https", "quic":
+		return true
+	}
+	return false
+}
+
+// startListener starts the listener in a new goroutine.
+// tlsConfig is required if ls.requireTLS.
+// The listener stops accepting new connections once d is closing.
+// The returned io.Closer closes the listener and all its connections.
+func startListener(ls *listenerSpec, d *drainHandler, tlsConfig *tls.Config) (io.Closer, error) {
+	var h dns_handler.Handler = d
+	if ls.log {
+		h = &loggingHandler{
+			next:   h,
+			name:   ls.name,
+			logger: mlog.L().Named("listener"),
+		}
+	}
+	h = &metricsHandler{
+		next:     h,
+		listener: ls.name,
+		protocol: ls.protocol,
+	}
+
+	s := &server.Server{
+		DNSHandler: h,
+		TLSConfig:  tlsConfig,
+		Logger:     mlog.L().Named("server"),
+	}
+	if ls.protocol == "https" || ls.protocol == "http" {
+		s.HttpHandler = &http_handler.Handler{
+			DNSHandler: h,
+			Path:       ls.path,
+			Logger:     mlog.L().Named("http_handler"),
+		}
+		if ls.protocol == "http" { // The server is behind a reverse proxy.
+			s.HttpHandler = &forwardedHandler{next: s.HttpHandler, trusted: ls.trustedProxies}
+		}
+	}
+
+	var serve func() error
+	var closer io.Closer = s
+	switch ls.protocol {
+	case "udp":
+		c, err := net.ListenPacket("udp", ls.addr)
+		if err != nil {
+			return nil, err
+		}
+		mlog.S().Infof("listening on udp socket %s", c.LocalAddr())
+		dc := &drainPacketConn{PacketConn: c, d: d}
+		serve = func() error { return s.ServeUDP(dc) }
+		go func() {
+			<-d.closingC
+			c.SetReadDeadline(time.Now())
+		}()
+	case "quic":
+		l, err := listenDoQ(ls.addr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		mlog.S().Infof("listening on quic socket %s", l.Addr())
+		// Closing a quic listener also closes its connections, so it is
+		// closed by the returned closer after d is drained. New connections
+		// are refused by doqServer once d is closing.
+		doqs := &doqServer{
+			handler:  h,
+			closingC: d.closingC,
+			logger:   mlog.L().Named("doq_server"),
+			l:        l,
+		}
+		serve = doqs.serve
+		closer = doqs
+	default:
+		l, err := net.Listen("tcp", ls.addr)
+		if err != nil {
+			return nil, err
+		}
+		mlog.S().Infof("listening on %s socket %s", ls.protocol, l.Addr())
+		dl := &drainListener{Listener: l, d: d}
+		switch ls.protocol {
+		case "tcp":
+			serve = func() error { return s.ServeTCP(dl) }
+		case "tls":
+			serve = func() error { return s.ServeTLS(dl) }
+		case "https":
+			serve = func() error { return s.ServeHTTPS(dl) }
+		case "http":
+			serve = func() error { return s.ServeHTTP(dl) }
+		}
+		go func() {
+			<-d.closingC
+			l.Close()
+		}()
+	}
+
+	go func() {
+		err := serve()
+		if d.closing() {
+			return
+		}
+		mlog.S().Fatalf("%s server exited: %v", ls.name, err)
+	}()
+	return closer, nil
+}
+
+// drainHandler tracks in-flight queries so that they can be drained
+// on shutdown. Once it is closing, new queries from connections that
+// are still open will be refused, so that clients can retry other
+// servers without waiting for a timeout.
+type drainHandler struct {
+	next dns_handler.Handler
+
+	m         sync.RWMutex
+	isClosing bool
+	wg        sync.WaitGroup
+	closingC  chan struct{} // closed when drain is called
+	drainedC  chan struct{} // closed when drain returns
+}
+
+func newDrainHandler(next dns_handler.Handler) *drainHandler {
+	return &drainHandler{
+		next:     next,
+		closingC: make(chan struct{}),
+		drainedC: make(chan struct{}),
+	}
+}
+
+func (d *drainHandler) ServeDNS(ctx context.Context, req *dns.Msg, w dns_handler.ResponseWriter, meta *handler.RequestMeta) error {
+	d.m.RLock()
+	if d.isClosing {
+		d.m.RUnlock()
+		r := new(dns.Msg)
+		r.SetRcode(req, dns.RcodeRefused)
+		return w.Write(r)
+	}
+	d.wg.Add(1)
+	d.m.RUnlock()
+	defer d.wg.Done()
+
+	return d.next.ServeDNS(ctx, req, w, meta)
+}
+
+func (d *drainHandler) closing() bool {
+	select {
+	case <-d.closingC:
+		return true
+	default:
+		return false
+	}
+}
+
+// drain stops accepting new queries and waits for in-flight queries.
+// It reports whether all queries were done before the timeout.
+func (d *drainHandler) drain(timeout time.Duration) bool {
+	d.m.Lock()
+	d.isClosing = true
+	d.m.Unlock()
+	close(d.closingC)
+	defer close(d.drainedC)
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// drainListener is a net.Listener that does not return from Accept until d
+// is drained once d is closing. server.Server cancels the contexts
+// of all in-flight queries and closes their connections as soon as its
+// Serve func returns.
+type drainListener struct {
+	net.Listener
+	d *drainHandler
+}
+
+func (l *drainListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil && l.d.closing() {
+		<-l.d.drainedC
+	}
+	return c, err
+}
+
+// drainPacketConn is the net.PacketConn version of drainListener.
+type drainPacketConn struct {
+	net.PacketConn
+	d *drainHandler
+}
+
+func (c *drainPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err != nil && c.d.closing() {
+		<-c.d.drainedC
+	}
+	return n, addr, err
+}
+
+// loggingHandler logs and counts queries that received by a listener.
+type loggingHandler struct {
+	next    dns_handler.Handler
+	name    string
+	queries uint64 // atomic
+	logger  *zap.Logger
+}
+
+func (h *loggingHandler) ServeDNS(ctx context.Context, req *dns.Msg, w dns_handler.ResponseWriter, meta *handler.RequestMeta) error {
+	n := atomic.AddUint64(&h.queries, 1)
+	var question string
+	if len(req.Question) >= 1 {
+		q := req.Question[0]
+		question = fmt.Sprintf("%s %s", q.Name, dns.TypeToString[q.Qtype])
+	}
+	h.logger.Info("query received",
+		zap.String("listener", h.name),
+		zap.Uint64("count", n),
+		zap.String("question", question),
+		zap.Stringer("client", meta.ClientIP),
+	)
+	return h.next.ServeDNS(ctx, req, w, meta)
+}
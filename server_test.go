@@ -0,0 +1,87 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/server/dns_handler"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+// blockingHandler answers queries after release is closed.
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingHandler) ServeDNS(_ context.Context, req *dns.Msg, w dns_handler.ResponseWriter, _ *handler.RequestMeta) error {
+	h.started <- struct{}{}
+	<-h.release
+	r := new(dns.Msg)
+	r.SetReply(req)
+	return w.Write(r)
+}
+
+type msgWriter struct {
+	c chan *dns.Msg
+}
+
+func (w *msgWriter) Write(m *dns.Msg) error {
+	w.c <- m
+	return nil
+}
+
+func Test_drainHandler(t *testing.T) {
+	bh := &blockingHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+	d := newDrainHandler(bh)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	inflight := &msgWriter{c: make(chan *dns.Msg, 1)}
+	go d.ServeDNS(context.Background(), q, inflight, nil)
+	<-bh.started
+
+	drained := make(chan bool)
+	go func() { drained <- d.drain(time.Second) }()
+	<-d.closingC
+
+	// new queries are refused while draining.
+	refused := &msgWriter{c: make(chan *dns.Msg, 1)}
+	if err := d.ServeDNS(context.Background(), q, refused, nil); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-refused.c; r.Rcode != dns.RcodeRefused || r.Id != q.Id {
+		t.Fatalf("want a REFUSED response, got %s", r)
+	}
+
+	select {
+	case <-drained:
+		t.Fatal("drain returned before the in-flight query is done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(bh.release)
+	if r := <-inflight.c; r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("the in-flight query should be answered, got %s", r)
+	}
+	if !<-drained {
+		t.Fatal("drain timeout")
+	}
+}
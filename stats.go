@@ -0,0 +1,360 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	dto "github.com/prometheus/client_model/go"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statsWindow = 60 // minutes
+	// statsMaxKeys is the max number of domains or clients counted in
+	// a minute. It limits the memory used by the stats.
+	statsMaxKeys = 10000
+)
+
+// statsBucket holds the stats of a minute.
+type statsBucket struct {
+	minute         int64 // unix time in minutes
+	queries        int
+	cacheHits      int
+	blocked        int
+	domains        map[string]int
+	blockedDomains map[string]int
+	clients        map[string]int
+	upstreams      map[upstreamKey]*upstreamCounter // deltas of the minute
+}
+
+type upstreamKey struct {
+	group string
+	addr  string
+}
+
+// upstreamCounter is the cumulative counter of an upstream.
+type upstreamCounter struct {
+	queries    uint64
+	errors     uint64
+	latencySum float64 // seconds
+}
+
+// queryStats is a queryLogSink that keeps the stats of the last hour
+// for the dashboard. Upstream health is read from the metrics.
+type queryStats struct {
+	m       sync.Mutex
+	buckets [statsWindow]*statsBucket // ring indexed by minute % statsWindow
+	last    map[upstreamKey]upstreamCounter
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+}
+
+var _ queryLogSink = (*queryStats)(nil)
+
+// newQueryStats creates a queryStats and starts a goroutine to collect
+// upstream stats every minute. Call Close to stop it.
+func newQueryStats() *queryStats {
+	s := &queryStats{
+		closeChan: make(chan struct{}),
+	}
+	s.last, _ = gatherUpstreamCounters()
+	go s.run()
+	return s
+}
+
+func (s *queryStats) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.collectUpstreams(time.Now())
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+// bucket returns the bucket of t. It returns nil if t is out of the window.
+// Caller must hold the lock.
+func (s *queryStats) bucket(t time.Time) *statsBucket {
+	minute := t.Unix() / 60
+	if minute <= time.Now().Unix()/60-statsWindow {
+		return nil
+	}
+	i := minute % statsWindow
+	b := s.buckets[i]
+	if b == nil || b.minute != minute {
+		if b != nil && b.minute > minute {
+			return nil
+		}
+		b = &statsBucket{
+			minute:         minute,
+			domains:        make(map[string]int),
+			blockedDomains: make(map[string]int),
+			clients:        make(map[string]int),
+			upstreams:      make(map[upstreamKey]*upstreamCounter),
+		}
+		s.buckets[i] = b
+	}
+	return b
+}
+
+func (s *queryStats) Write(rec *queryRecord) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	b := s.bucket(rec.Time)
+	if b == nil {
+		return nil
+	}
+	b.queries++
+	domain := strings.TrimSuffix(strings.ToLower(rec.QName), ".")
+	switch rec.Route {
+	case "cache":
+		b.cacheHits++
+	case "blacklist":
+		b.blocked++
+		countKey(b.blockedDomains, domain)
+	}
+	countKey(b.domains, domain)
+	countKey(b.clients, rec.Client)
+	return nil
+}
+
+func countKey(m map[string]int, k string) {
+	if len(k) == 0 {
+		return
+	}
+	if _, ok := m[k]; ok || len(m) < statsMaxKeys {
+		m[k]++
+	}
+}
+
+// collectUpstreams stores the upstream counter deltas since the last
+// collection to the bucket of t.
+func (s *queryStats) collectUpstreams(t time.Time) {
+	counters, err := gatherUpstreamCounters()
+	if err != nil {
+		mlog.S().Warnf("failed to gather upstream metrics, %v", err)
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	b := s.bucket(t)
+	for k, c := range counters {
+		l := s.last[k]
+		if b != nil {
+			b.upstreams[k] = &upstreamCounter{
+				queries:    c.queries - l.queries,
+				errors:     c.errors - l.errors,
+				latencySum: c.latencySum - l.latencySum,
+			}
+		}
+	}
+	s.last = counters
+}
+
+// gatherUpstreamCounters reads the upstream counters from the metrics.
+func gatherUpstreamCounters() (map[upstreamKey]upstreamCounter, error) {
+	mfs, err := metricsRegistry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	counters := make(map[upstreamKey]upstreamCounter)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			k := upstreamKeyOf(m)
+			c := counters[k]
+			switch mf.GetName() {
+			case metricsNamespace + "_upstream_duration_seconds":
+				c.queries = m.GetHistogram().GetSampleCount()
+				c.latencySum = m.GetHistogram().GetSampleSum()
+			case metricsNamespace + "_upstream_errors_total":
+				c.errors = uint64(m.GetCounter().GetValue())
+			default:
+				continue
+			}
+			counters[k] = c
+		}
+	}
+	return counters, nil
+}
+
+func upstreamKeyOf(m *dto.Metric) upstreamKey {
+	var k upstreamKey
+	for _, l := range m.GetLabel() {
+		switch l.GetName() {
+		case "group":
+			k.group = l.GetValue()
+		case "upstream":
+			k.addr = l.GetValue()
+		}
+	}
+	return k
+}
+
+func (s *queryStats) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+	})
+	return nil
+}
+
+// statsReport is the stats of the last hour.
+type statsReport struct {
+	Queries       int              `json:"queries"`
+	CacheHits     int              `json:"cache_hits"`
+	CacheHitRatio float64          `json:"cache_hit_ratio"`
+	Blocked       int              `json:"blocked"`
+	Minutes       []minuteReport   `json:"minutes"` // from old to new
+	TopDomains    []keyCount       `json:"top_domains"`
+	TopBlocked    []keyCount       `json:"top_blocked"`
+	TopClients    []keyCount       `json:"top_clients"`
+	Upstreams     []upstreamReport `json:"upstreams"`
+}
+
+type minuteReport struct {
+	Time      time.Time `json:"time"`
+	QPS       float64   `json:"qps"`
+	CacheHits int       `json:"cache_hits"`
+	Blocked   int       `json:"blocked"`
+}
+
+type keyCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type upstreamReport struct {
+	Group     string  `json:"group"`
+	Upstream  string  `json:"upstream"`
+	Queries   uint64  `json:"queries"`
+	Errors    uint64  `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	Latency   float64 `json:"avg_latency_ms"`
+}
+
+// report returns the stats of the last hour with top n domains and clients.
+func (s *queryStats) report(n int) *statsReport {
+	current, err := gatherUpstreamCounters()
+	if err != nil {
+		mlog.S().Warnf("failed to gather upstream metrics, %v", err)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	r := new(statsReport)
+	domains := make(map[string]int)
+	blockedDomains := make(map[string]int)
+	clients := make(map[string]int)
+	upstreams := make(map[upstreamKey]*upstreamCounter)
+	now := time.Now().Unix() / 60
+	for minute := now - statsWindow + 1; minute <= now; minute++ {
+		mr := minuteReport{Time: time.Unix(minute*60, 0)}
+		if b := s.buckets[minute%statsWindow]; b != nil && b.minute == minute {
+			r.Queries += b.queries
+			r.CacheHits += b.cacheHits
+			r.Blocked += b.blocked
+			mr.QPS = float64(b.queries) / 60
+			mr.CacheHits = b.cacheHits
+			mr.Blocked = b.blocked
+			mergeCounts(domains, b.domains)
+			mergeCounts(blockedDomains, b.blockedDomains)
+			mergeCounts(clients, b.clients)
+			for k, c := range b.upstreams {
+				u := upstreams[k]
+				if u == nil {
+					u = new(upstreamCounter)
+					upstreams[k] = u
+				}
+				u.queries += c.queries
+				u.errors += c.errors
+				u.latencySum += c.latencySum
+			}
+		}
+		r.Minutes = append(r.Minutes, mr)
+	}
+	// add upstream stats since the last collection. Idle upstreams
+	// are also reported.
+	for k, c := range current {
+		l := s.last[k]
+		u := upstreams[k]
+		if u == nil {
+			u = new(upstreamCounter)
+			upstreams[k] = u
+		}
+		u.queries += c.queries - l.queries
+		u.errors += c.errors - l.errors
+		u.latencySum += c.latencySum - l.latencySum
+	}
+	if r.Queries > 0 {
+		r.CacheHitRatio = float64(r.CacheHits) / float64(r.Queries)
+	}
+	r.TopDomains = topN(domains, n)
+	r.TopBlocked = topN(blockedDomains, n)
+	r.TopClients = topN(clients, n)
+
+	r.Upstreams = make([]upstreamReport, 0, len(upstreams))
+	for k, c := range upstreams {
+		ur := upstreamReport{Group: k.group, Upstream: k.addr, Queries: c.queries, Errors: c.errors}
+		if total := c.queries + c.errors; total > 0 {
+			ur.ErrorRate = float64(c.errors) / float64(total)
+		}
+		if c.queries > 0 {
+			ur.Latency = c.latencySum / float64(c.queries) * 1000
+		}
+		r.Upstreams = append(r.Upstreams, ur)
+	}
+	sort.Slice(r.Upstreams, func(i, j int) bool {
+		a, b := r.Upstreams[i], r.Upstreams[j]
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		return a.Upstream < b.Upstream
+	})
+	return r
+}
+
+func mergeCounts(dst, src map[string]int) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+// topN returns the n keys with the largest counts.
+func topN(m map[string]int, n int) []keyCount {
+	s := make([]keyCount, 0, len(m))
+	for k, v := range m {
+		s = append(s, keyCount{Key: k, Count: v})
+	}
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].Count != s[j].Count {
+			return s[i].Count > s[j].Count
+		}
+		return s[i].Key < s[j].Key
+	})
+	if len(s) > n {
+		s = s[:n]
+	}
+	return s
+}
@@ -19,28 +19,145 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
 	"github.com/IrineSistiana/mosdns/v3/dispatcher/pkg/matcher/msg_matcher"
 	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
 )
 
 type blackList struct {
-	m *msg_matcher.QNameMatcher
+	m     *msg_matcher.QNameMatcher
+	allow []*msg_matcher.QNameMatcher // exempt names from m
+	resp  *blockResponse
 }
 
 func (b *blackList) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
 	q := qCtx.Q()
+	for _, allow := range b.allow {
+		if allow.MatchMsg(q) {
+			return handler.ExecChainNode(ctx, qCtx, next)
+		}
+	}
 	if b.m.MatchMsg(q) {
-		r := new(dns.Msg)
-		r.SetReply(q)
-		r.Rcode = dns.RcodeNameError
-		qCtx.SetResponse(r, handler.ContextStatusRejected)
+		if r := b.resp.reply(q); r != nil {
+			qCtx.SetResponse(r, handler.ContextStatusRejected)
+		} else {
+			qCtx.SetResponse(nil, handler.ContextStatusDropped)
+		}
+		qCtx.AddMark(markRouteBlacklist)
+		blacklistHitsTotal.Inc()
 		return nil
 	}
 
 	return handler.ExecChainNode(ctx, qCtx, next)
 }
 
+// blockResponse builds responses for blocked queries.
+type blockResponse struct {
+	mode string // nxdomain, nodata, refused, ip or drop
+	ipv4 net.IP // for mode ip, nil means no A record
+	ipv6 net.IP // for mode ip, nil means no AAAA record
+	ttl  uint32
+	soa  bool // add a SOA to negative responses
+}
+
+// newBlockResponse parses the mode of the block response. The mode
+// can be nxdomain, nodata, refused, zero-ip, drop, or ip addresses
+// like "10.0.0.1,fd00::1", one of them can be omitted.
+func newBlockResponse(mode string, ttl uint32, soa bool) (*blockResponse, error) {
+	b := &blockResponse{mode: mode, ttl: ttl, soa: soa}
+	switch mode {
+	case "", "nxdomain":
+		b.mode = "nxdomain"
+	case "nodata", "refused", "drop":
+	case "zero-ip":
+		b.mode = "ip"
+		b.ipv4 = net.IPv4zero.To4()
+		b.ipv6 = net.IPv6zero
+	default:
+		b.mode = "ip"
+		for _, s := range strings.Split(mode, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			switch {
+			case ip == nil:
+				return nil, fmt.Errorf("invalid block response %s", mode)
+			case ip.To4() != nil:
+				b.ipv4 = ip.To4()
+			default:
+				b.ipv6 = ip
+			}
+		}
+	}
+	return b, nil
+}
+
+// reply returns the response to q. It returns nil if q should be dropped.
+func (b *blockResponse) reply(q *dns.Msg) *dns.Msg {
+	if b.mode == "drop" {
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+	switch b.mode {
+	case "nxdomain":
+		r.Rcode = dns.RcodeNameError
+	case "refused":
+		r.Rcode = dns.RcodeRefused
+		return r
+	case "ip":
+		if len(q.Question) != 1 {
+			break
+		}
+		question := q.Question[0]
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: question.Qclass, Ttl: b.ttl}
+		switch {
+		case question.Qtype == dns.TypeA && b.ipv4 != nil:
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: b.ipv4})
+		case question.Qtype == dns.TypeAAAA && b.ipv6 != nil:
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: b.ipv6})
+		}
+	}
+	if len(r.Answer) == 0 && b.soa && len(q.Question) == 1 {
+		r.Ns = append(r.Ns, blockSOA(q.Question[0].Name, b.ttl))
+	}
+	return r
+}
+
+// blockSOA returns a fake SOA record of name for negative caching.
+func blockSOA(name string, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "blocked.invalid.",
+		Mbox:    "hostmaster.blocked.invalid.",
+		Serial:  1,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  ttl,
+	}
+}
+
+// Marks of handler.Context. They record which node answered the query.
+const (
+	markRouteHosts     uint = iota + 1
+	markRouteBlacklist      // blocked by the blacklist
+	markRouteCache
+	markRouteUpstream // forwarded to the upstream, no diversion
+	markRouteLocal    // forwarded to the local upstream
+	markRouteRemote   // forwarded to the remote upstream
+	markRouteRecords  // answered by the local records
+	markRouteZone     // answered by the authoritative zones
+	markRouteRejected // rejected by the client acl
+	markRouteSafeSearch
+	markRouteGroup      // forwarded to an upstream group by the forward rules
+	markRoutePrivatePTR // reverse lookups of private addresses
+)
+
 type end struct{}
 
 func (e *end) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
@@ -53,3 +170,45 @@ func (d *dropResponse) Exec(ctx context.Context, qCtx *handler.Context, next han
 	qCtx.SetResponse(nil, handler.ContextStatusDropped)
 	return handler.ExecChainNode(ctx, qCtx, next)
 }
+
+// parsePTRName parses the ip address of a reverse lookup name.
+// e.g. "4.3.2.1.in-addr.arpa.", "b.a.9.8...ip6.arpa.".
+func parsePTRName(name string) (netip.Addr, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		var b [4]byte
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			b[3-i] = byte(n)
+		}
+		return netip.AddrFrom4(b), true
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+		if len(labels) != 32 {
+			return netip.Addr{}, false
+		}
+		var b [16]byte
+		for i, l := range labels {
+			n, err := strconv.ParseUint(l, 16, 4)
+			if err != nil || len(l) != 1 {
+				return netip.Addr{}, false
+			}
+			j := 31 - i // nibble index
+			if j%2 == 0 {
+				b[j/2] |= byte(n) << 4
+			} else {
+				b[j/2] |= byte(n)
+			}
+		}
+		return netip.AddrFrom16(b), true
+	}
+	return netip.Addr{}, false
+}
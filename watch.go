@@ -0,0 +1,111 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/mlog"
+	"github.com/fsnotify/fsnotify"
+	"path/filepath"
+	"time"
+)
+
+// watchDebounce is the quiet period after the last file event before
+// rule sets are reloaded. Editors and downloaders often write a file
+// in several steps.
+const watchDebounce = time.Second
+
+// fileWatcher reloads rule sets when their files are changed.
+type fileWatcher struct {
+	w    *fsnotify.Watcher
+	sets map[string][]ruleSet // key is the absolute file path
+}
+
+// newFileWatcher starts watching files of sets.
+func newFileWatcher(sets []ruleSet) (*fileWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	fw := &fileWatcher{w: w, sets: make(map[string][]ruleSet)}
+
+	// Watch dirs instead of files. Files that are replaced by
+	// renaming can't be watched by their old inodes.
+	dirs := make(map[string]struct{})
+	for _, s := range sets {
+		for _, f := range s.Files() {
+			if isRemoteFile(f) { // updated by the remoteRefresher
+				continue
+			}
+			p, err := filepath.Abs(f)
+			if err != nil {
+				w.Close()
+				return nil, err
+			}
+			fw.sets[p] = append(fw.sets[p], s)
+			dirs[filepath.Dir(p)] = struct{}{}
+		}
+	}
+	for d := range dirs {
+		if err := w.Add(d); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+
+	go fw.run()
+	return fw, nil
+}
+
+func (fw *fileWatcher) run() {
+	pending := make(map[ruleSet]struct{})
+	var reloadTimer <-chan time.Time
+	for {
+		select {
+		case e, ok := <-fw.w.Events:
+			if !ok {
+				return
+			}
+			if e.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			sets := fw.sets[filepath.Clean(e.Name)]
+			if len(sets) == 0 {
+				continue
+			}
+			mlog.S().Debugf("file %s changed", e.Name)
+			for _, s := range sets {
+				pending[s] = struct{}{}
+			}
+			reloadTimer = time.After(watchDebounce)
+		case err, ok := <-fw.w.Errors:
+			if !ok {
+				return
+			}
+			mlog.S().Warnf("file watcher error, %v", err)
+		case <-reloadTimer:
+			reloadTimer = nil
+			reloadRuleSets(pending)
+			pending = make(map[ruleSet]struct{})
+		}
+	}
+}
+
+// Close stops the watching.
+func (fw *fileWatcher) Close() error {
+	return fw.w.Close()
+}
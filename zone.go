@@ -0,0 +1,381 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v3/dispatcher/handler"
+	"github.com/miekg/dns"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// zoneSet is an executable that answers queries of its zones
+// authoritatively. It can be reloaded at runtime.
+type zoneSet struct {
+	tag    string
+	files  []string
+	remote *remoteCache
+	z      atomic.Value // []*zone, longer origins first
+	rules  map[string]struct{}
+}
+
+var (
+	_ ruleSet            = (*zoneSet)(nil)
+	_ handler.Executable = (*zoneSet)(nil)
+)
+
+// newZoneSet loads zones from RFC 1035 zone files. Each file is a zone,
+// its origin is the owner of its SOA record. Each element of files is a
+// file or in the format "origin=file". See zoneFileOrigin for the origin
+// of relative names.
+func newZoneSet(tag string, files []string, remote *remoteCache) (*zoneSet, error) {
+	s := &zoneSet{tag: tag, files: files, remote: remote}
+	if _, _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *zoneSet) Tag() string {
+	return s.tag
+}
+
+func (s *zoneSet) Files() []string {
+	ps := make([]string, 0, len(s.files))
+	for _, f := range s.files {
+		_, file := splitZoneArg(f)
+		ps = append(ps, file)
+	}
+	return ps
+}
+
+func (s *zoneSet) Len() int {
+	return len(s.rules)
+}
+
+func (s *zoneSet) load() (added, removed int, err error) {
+	var zones []*zone
+	var rules map[string]struct{}
+	err = s.remote.withBackup(func(localFile localFileFunc) (err error) {
+		zones, rules, err = s.parse(localFile)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	added, removed = diffRules(s.rules, rules)
+	s.z.Store(zones)
+	s.rules = rules
+	return added, removed, nil
+}
+
+func (s *zoneSet) check(localFile localFileFunc) error {
+	_, _, err := s.parse(localFile)
+	return err
+}
+
+func (s *zoneSet) parse(localFile localFileFunc) ([]*zone, map[string]struct{}, error) {
+	var zones []*zone
+	rules := make(map[string]struct{})
+	origins := make(map[string]struct{})
+	for _, f := range s.files {
+		origin, file := splitZoneArg(f)
+		lf, err := localFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		z, err := loadZoneFile(lf, origin, rules)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load zone file %s, %w", file, err)
+		}
+		if _, dup := origins[z.origin]; dup {
+			return nil, nil, fmt.Errorf("duplicated zone %s", z.origin)
+		}
+		origins[z.origin] = struct{}{}
+		zones = append(zones, z)
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		return dns.CountLabel(zones[i].origin) > dns.CountLabel(zones[j].origin)
+	})
+	return zones, rules, nil
+}
+
+// Exec answers the query if its name is in a zone. CNAME targets that
+// are in none of the zones will be resolved by the rest of the chain.
+func (s *zoneSet) Exec(ctx context.Context, qCtx *handler.Context, next handler.ExecutableChainNode) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	z := s.find(q.Question[0].Name)
+	if z == nil {
+		return handler.ExecChainNode(ctx, qCtx, next)
+	}
+	r, target := s.reply(z, q)
+	if len(target) > 0 {
+		if err := resolveCNAMETarget(ctx, qCtx, next, r, target); err != nil {
+			return err
+		}
+	}
+	qCtx.SetResponse(r, handler.ContextStatusResponded)
+	qCtx.AddMark(markRouteZone)
+	return nil
+}
+
+// find returns the zone that name belongs to, or nil.
+func (s *zoneSet) find(name string) *zone {
+	name = strings.ToLower(name)
+	for _, z := range s.z.Load().([]*zone) {
+		if dns.IsSubDomain(z.origin, name) {
+			return z
+		}
+	}
+	return nil
+}
+
+// reply answers q from z. CNAME targets in the other zones are followed.
+// target is the CNAME target that is in none of the zones.
+func (s *zoneSet) reply(z *zone, q *dns.Msg) (r *dns.Msg, target string) {
+	r, target = z.reply(q)
+	for i := 0; len(target) > 0; i++ {
+		tz := s.find(target)
+		if tz == nil {
+			return r, target
+		}
+		if i >= maxCNAMEChain { // CNAMEs that point to each other
+			r.Rcode = dns.RcodeServerFailure
+			return r, ""
+		}
+		subQ := q.Copy()
+		subQ.Question[0].Name = target
+		var subR *dns.Msg
+		subR, target = tz.reply(subQ)
+		r.Rcode = subR.Rcode
+		r.Answer = append(r.Answer, subR.Answer...)
+		if subR.Authoritative { // not a referral
+			r.Ns = subR.Ns
+		}
+	}
+	return r, ""
+}
+
+// zone is an authoritative zone.
+type zone struct {
+	origin string // lower case fqdn
+	soa    *dns.SOA
+	// names maps lower case fqdn to its records by type. Empty
+	// non-terminals have empty maps.
+	names map[string]map[uint16][]dns.RR
+}
+
+// splitZoneArg splits a zone arg in the format "origin=file". If s has no
+// origin, the origin is guessed from the file name by zoneFileOrigin.
+func splitZoneArg(s string) (origin, file string) {
+	if o, f, ok := strings.Cut(s, "="); ok && !strings.ContainsAny(o, `/\:`) {
+		o, f = strings.TrimSpace(o), strings.TrimSpace(f)
+		if _, ok := dns.IsDomainName(o); ok && len(o) > 0 && len(f) > 0 {
+			return dns.Fqdn(o), f
+		}
+	}
+	return zoneFileOrigin(s), s
+}
+
+// zoneFileOrigin returns the origin of relative names in a zone file that
+// has no $ORIGIN, guessed from its file name in BIND's conventions,
+// e.g. "db.lan", "lan.example.zone" or "lan.example.db". Otherwise it
+// returns an empty string, and relative names in the file are errors.
+func zoneFileOrigin(file string) string {
+	name := file
+	if i := strings.IndexByte(name, '?'); i >= 0 && strings.Contains(name, "://") {
+		name = name[:i]
+	}
+	name = name[strings.LastIndexAny(name, `/\`)+1:]
+	base := name
+	name = strings.TrimPrefix(name, "db.")
+	name = strings.TrimSuffix(name, ".zone")
+	name = strings.TrimSuffix(name, ".db")
+	if name == base {
+		return ""
+	}
+	if _, ok := dns.IsDomainName(name); !ok || len(name) == 0 || strings.HasPrefix(name, ".") {
+		return ""
+	}
+	return dns.Fqdn(strings.ToLower(name))
+}
+
+func loadZoneFile(file, origin string, rules map[string]struct{}) (*zone, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	z := &zone{names: make(map[string]map[uint16][]dns.RR)}
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(f, origin, file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if z.soa != nil {
+				return nil, errors.New("multiple SOA records")
+			}
+			z.soa = soa
+			z.origin = strings.ToLower(soa.Hdr.Name)
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if z.soa == nil {
+		return nil, errors.New("missing SOA record")
+	}
+
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if !dns.IsSubDomain(z.origin, name) {
+			return nil, fmt.Errorf("%s is out of the zone %s", hdr.Name, z.origin)
+		}
+		types := z.names[name]
+		if types == nil {
+			types = make(map[uint16][]dns.RR)
+			z.names[name] = types
+		}
+		types[hdr.Rrtype] = append(types[hdr.Rrtype], rr)
+		rules[rr.String()] = struct{}{}
+
+		// add empty non-terminals
+		for p := parentName(name); p != "" && dns.IsSubDomain(z.origin, p); p = parentName(p) {
+			if _, ok := z.names[p]; ok {
+				break
+			}
+			z.names[p] = make(map[uint16][]dns.RR)
+		}
+	}
+	for name, types := range z.names {
+		if len(types[dns.TypeCNAME]) > 0 && len(types) > 1 {
+			return nil, fmt.Errorf("%s has a CNAME record and other records", name)
+		}
+	}
+	return z, nil
+}
+
+// parentName returns the parent of a fqdn, or an empty string if name
+// is the root.
+func parentName(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return ""
+	}
+	return name[i:]
+}
+
+// reply returns the response to q whose name is in the zone. If the
+// answer ends with a CNAME that points out of the zone, the target will
+// be returned.
+func (z *zone) reply(q *dns.Msg) (r *dns.Msg, target string) {
+	question := q.Question[0]
+	r = new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	r.RecursionAvailable = true
+
+	name := question.Name
+	for i := 0; ; i++ {
+		lname := strings.ToLower(name)
+		if !dns.IsSubDomain(z.origin, lname) {
+			return r, name
+		}
+		if ns := z.delegation(lname); ns != nil {
+			if i == 0 { // referral
+				r.Authoritative = false
+				r.Ns = appendRRs(nil, ns, ns[0].Header().Name)
+			}
+			return r, ""
+		}
+
+		types, ok := z.names[lname]
+		if !ok {
+			types, ok = z.wildcard(lname)
+		}
+		if !ok {
+			r.Rcode = dns.RcodeNameError
+			r.Ns = []dns.RR{z.negativeSOA()}
+			return r, ""
+		}
+
+		if question.Qtype == dns.TypeANY {
+			for _, rrs := range types {
+				r.Answer = appendRRs(r.Answer, rrs, name)
+			}
+		} else if rrs := types[question.Qtype]; len(rrs) > 0 {
+			r.Answer = appendRRs(r.Answer, rrs, name)
+		} else if cname := types[dns.TypeCNAME]; len(cname) > 0 {
+			r.Answer = appendRRs(r.Answer, cname, name)
+			if i >= maxCNAMEChain {
+				r.Rcode = dns.RcodeServerFailure
+				return r, ""
+			}
+			name = cname[0].(*dns.CNAME).Target
+			continue
+		}
+		if len(r.Answer) == 0 { // no data
+			r.Ns = []dns.RR{z.negativeSOA()}
+		}
+		return r, ""
+	}
+}
+
+// delegation returns the NS records of the zone cut that name is at
+// or below. It returns nil if name is not delegated.
+func (z *zone) delegation(name string) []dns.RR {
+	var cut []dns.RR
+	for p := name; p != z.origin && p != ""; p = parentName(p) {
+		if ns := z.names[p][dns.TypeNS]; len(ns) > 0 {
+			cut = ns // keep the topmost cut
+		}
+	}
+	return cut
+}
+
+// wildcard returns the records of the wildcard that matches name.
+func (z *zone) wildcard(name string) (map[uint16][]dns.RR, bool) {
+	// find the closest encloser
+	for p := parentName(name); p != "" && dns.IsSubDomain(z.origin, p); p = parentName(p) {
+		if _, ok := z.names[p]; ok {
+			types, ok := z.names["*."+p]
+			return types, ok
+		}
+	}
+	return nil, false
+}
+
+// negativeSOA returns the SOA for negative responses. Its TTL is the
+// negative caching TTL of RFC 2308.
+func (z *zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
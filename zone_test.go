@@ -0,0 +1,172 @@
+//     Copyright (C) 2020-2021, IrineSistiana
+//
+//     This file is part of mosdns.
+//
+//     mosdns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mosdns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// relativeZone is a zone file without $ORIGIN, all names are relative.
+const relativeZone = `$TTL 3600
+@       IN SOA  ns hostmaster 1 3600 600 86400 60
+        IN NS   ns
+ns      IN A    192.168.1.1
+www     IN A    192.168.1.10
+nas     IN CNAME www
+`
+
+func writeZoneFile(t *testing.T, name, body string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func Test_zoneSet_relativeNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		arg    func(p string) string
+		origin string
+	}{
+		{"origin from arg", "lan.txt", func(p string) string { return "lan.example=" + p }, "lan.example."},
+		{"db. prefix", "db.lan.example", func(p string) string { return p }, "lan.example."},
+		{".zone suffix", "lan.example.zone", func(p string) string { return p }, "lan.example."},
+		{"single label", "db.lan", func(p string) string { return p }, "lan."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := writeZoneFile(t, tt.file, relativeZone)
+			s, err := newZoneSet("zone", []string{tt.arg(p)}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files := s.Files(); len(files) != 1 || files[0] != p {
+				t.Fatalf("Files() = %v, want [%s]", files, p)
+			}
+			if s.Len() != 5 {
+				t.Fatalf("Len() = %d, want 5", s.Len())
+			}
+
+			r := execQuery(t, s, nil, "nas."+tt.origin, dns.TypeA)
+			if r == nil || r.Rcode != dns.RcodeSuccess || !r.Authoritative || len(r.Answer) != 2 {
+				t.Fatalf("unexpected reply %v", r)
+			}
+			if a, ok := r.Answer[1].(*dns.A); !ok || a.Hdr.Name != "www."+tt.origin || a.A.String() != "192.168.1.10" {
+				t.Fatalf("unexpected answer %v", r.Answer[1])
+			}
+
+			r = execQuery(t, s, nil, "none."+tt.origin, dns.TypeA)
+			if r == nil || r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 || r.Ns[0].Header().Name != tt.origin {
+				t.Fatalf("unexpected reply %v", r)
+			}
+		})
+	}
+}
+
+func Test_zoneSet_noOrigin(t *testing.T) {
+	// relative names can't be resolved without an origin
+	p := writeZoneFile(t, "zone.txt", relativeZone)
+	if _, err := newZoneSet("zone", []string{p}, nil); err == nil {
+		t.Fatal("relative names without an origin are loaded")
+	}
+
+	// $ORIGIN in the file takes precedence
+	p = writeZoneFile(t, "db.other.example", "$ORIGIN lan.example.\n"+relativeZone)
+	s, err := newZoneSet("zone", []string{p}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := execQuery(t, s, nil, "www.lan.example.", dns.TypeA); r == nil || len(r.Answer) != 1 {
+		t.Fatalf("unexpected reply %v", r)
+	}
+}
+
+func Test_splitZoneArg(t *testing.T) {
+	tests := []struct {
+		s, origin, file string
+	}{
+		{"lan.example=/etc/lan.zone", "lan.example.", "/etc/lan.zone"},
+		{"lan=db.home", "lan.", "db.home"},
+		{"/etc/db.lan.example", "lan.example.", "/etc/db.lan.example"},
+		{"/etc/lan.example.db", "lan.example.", "/etc/lan.example.db"},
+		{`C:\zones\db.lan`, "lan.", `C:\zones\db.lan`},
+		{"/etc/zone", "", "/etc/zone"},
+		{"https://example.com/get?name=lan.example.zone", "", "https://example.com/get?name=lan.example.zone"},
+		{"https://example.com/db.lan?v=1", "lan.", "https://example.com/db.lan?v=1"},
+	}
+	for _, tt := range tests {
+		origin, file := splitZoneArg(tt.s)
+		if origin != tt.origin || file != tt.file {
+			t.Errorf("splitZoneArg(%q) = %q, %q, want %q, %q", tt.s, origin, file, tt.origin, tt.file)
+		}
+	}
+}
+
+func Test_zoneSet_crossZoneCNAME(t *testing.T) {
+	lan := writeZoneFile(t, "db.lan.example", `$TTL 3600
+@       IN SOA  ns hostmaster 1 3600 600 86400 60
+nas     IN CNAME www.corp.example.
+gone    IN CNAME none.corp.example.
+loop    IN CNAME loop.corp.example.
+ext     IN CNAME www.example.com.
+`)
+	corp := writeZoneFile(t, "db.corp.example", `$TTL 3600
+@       IN SOA  ns hostmaster 1 3600 600 86400 60
+www     IN A    10.0.0.1
+loop    IN CNAME loop.lan.example.
+`)
+	s, err := newZoneSet("zone", []string{lan, corp}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &fakeUpstream{reply: func(q *dns.Msg) *dns.Msg { return answerA(q, 300) }}
+
+	r := execQuery(t, s, upstream, "nas.lan.example.", dns.TypeA)
+	if r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 2 {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	if a, ok := r.Answer[1].(*dns.A); !ok || a.Hdr.Name != "www.corp.example." || a.A.String() != "10.0.0.1" {
+		t.Fatalf("unexpected answer %v", r.Answer[1])
+	}
+
+	r = execQuery(t, s, upstream, "gone.lan.example.", dns.TypeA)
+	if r == nil || r.Rcode != dns.RcodeNameError || len(r.Answer) != 1 || len(r.Ns) != 1 || r.Ns[0].Header().Name != "corp.example." {
+		t.Fatalf("unexpected reply %v", r)
+	}
+
+	r = execQuery(t, s, upstream, "loop.lan.example.", dns.TypeA)
+	if r == nil || r.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("unexpected reply %v", r)
+	}
+
+	if n := upstream.count(); n != 0 {
+		t.Fatalf("targets in the zones are sent to the upstream %d times", n)
+	}
+
+	// targets that are in none of the zones are resolved by the upstream.
+	r = execQuery(t, s, upstream, "ext.lan.example.", dns.TypeA)
+	if r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 2 || upstream.count() != 1 {
+		t.Fatalf("unexpected reply %v", r)
+	}
+}